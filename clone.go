@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Files of the cluster file system: the guest configs of every node and the storage config
+var (
+	pveNodesDir      = "/etc/pve/nodes"
+	pveStorageConfig = "/etc/pve/storage.cfg"
+)
+
+type cloneOptions struct {
+	vmid     int
+	snapshot string // snapshot name without the dataset
+	newVMID  int
+	destroy  bool // destroy the clone with VMID newVMID
+}
+
+func (o *cloneOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid", "new-vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--%s' requires a VMID", name)
+		}
+		if name == "vmid" {
+			o.vmid = vmid
+		} else {
+			o.newVMID = vmid
+		}
+	case "snapshot":
+		if value == "" || strings.ContainsAny(value, "@/") {
+			return true, fmt.Errorf("option '--snapshot' requires a snapshot name without the dataset")
+		}
+		o.snapshot = value
+	case "destroy-clone":
+		o.destroy = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Clone a guest from a snapshot or destroy such a clone
+func cloneCommand(ctx context.Context, e Exec, args []string) error {
+	var options cloneOptions
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	if options.newVMID == 0 || !options.destroy && (options.vmid == 0 || options.snapshot == "") {
+		return &UsageError{fmt.Errorf("clone requires --vmid, --snapshot and --new-vmid, or --destroy-clone and --new-vmid")}
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	if options.destroy {
+		return destroyClone(ctx, e, source, env, options.newVMID)
+	}
+	return cloneGuest(ctx, e, source, env, options)
+}
+
+// Hold tag of the snapshots which clones of a guest are created from
+func cloneTag(newVMID int) string {
+	return fmt.Sprintf("pve-zfs-snap-clone-%d", newVMID)
+}
+
+// Path of the config of a guest on a node
+func guestConfigPath(node string, guestType string, vmid int) string {
+	dir := "qemu-server"
+	if guestType == "lxc" {
+		dir = "lxc"
+	}
+	return filepath.Join(pveNodesDir, node, dir, fmt.Sprintf("%d.conf", vmid))
+}
+
+// Clone all disks of a guest from a snapshot and register the clone on the node
+func cloneGuest(ctx context.Context, e Exec, source VMSource, env environment, options cloneOptions) error {
+	resources, err := source.ClusterResources(ctx)
+	if err != nil {
+		return err
+	}
+	for _, vm := range resources {
+		if vm.VMID == options.newVMID {
+			return fmt.Errorf("VMID %d is already used by %s on node %s", vm.VMID, vm.ID, vm.Node)
+		}
+	}
+	guest, disks, err := findGuest(ctx, e, source, env, options.vmid)
+	if err != nil {
+		return err
+	}
+	config, err := os.ReadFile(guestConfigPath(env.hostname, guest.Type, guest.VMID))
+	if err != nil {
+		return err
+	}
+
+	// Names of the clones by the names of the disks
+	clones := make(map[string]string)
+	var snapshots []string
+	for _, pool := range sortedPools(disks) {
+		poolSnapshots, err := ZfsListPoolSnapshots(ctx, e, pool)
+		if err != nil {
+			return err
+		}
+		for _, disk := range disks[pool] {
+			name := disk.name + "@" + options.snapshot
+			if _, err := snapshotsAfter(poolSnapshots[disk.name], name); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, name)
+			clones[disk.name] = renameDisk(disk.name, options.newVMID)
+		}
+	}
+
+	// The snapshots are held, so that pruning skips them while the clone exists
+	tag := cloneTag(options.newVMID)
+	if _, err := command(ctx, e, "zfs", append([]string{"hold", tag}, snapshots...)...); err != nil {
+		return err
+	}
+	var created []string
+	cleanup := func() {
+		for _, name := range created {
+			command(ctx, e, "zfs", "destroy", name)
+		}
+		command(ctx, e, "zfs", append([]string{"release", tag}, snapshots...)...)
+	}
+	for _, snapshot := range snapshots {
+		disk, _, _ := strings.Cut(snapshot, "@")
+		if _, err := command(ctx, e, "zfs", "clone", snapshot, clones[disk]); err != nil {
+			cleanup()
+			return err
+		}
+		created = append(created, clones[disk])
+		fmt.Printf("cloned %s to %s\n", snapshot, clones[disk])
+	}
+
+	storages, err := zfsStorages(pveStorageConfig)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	volumes := make(map[string]string)
+	for storage, pool := range storages {
+		for disk, clone := range clones {
+			if path.Dir(disk) == pool {
+				volumes[storage+":"+path.Base(disk)] = storage + ":" + path.Base(clone)
+			}
+		}
+	}
+	newConfig, dropped := cloneConfig(string(config), volumes)
+	for _, line := range dropped {
+		fmt.Printf("dropped '%s' from the config, the volume is not a cloned ZFS disk\n", line)
+	}
+	configPath := guestConfigPath(env.hostname, guest.Type, options.newVMID)
+	if err := os.WriteFile(configPath, []byte(newConfig), 0o640); err != nil {
+		cleanup()
+		return err
+	}
+	fmt.Printf("registered %s %d on node %s, network interfaces are disconnected\n", guest.Type, options.newVMID, env.hostname)
+	return nil
+}
+
+var diskPrefixRE = regexp.MustCompile(`^(vm|subvol|base|basevol)-[0-9]+-disk-`)
+
+// Prefixes of the cloned disks, the disks of a template become the disks of a regular guest
+var clonePrefixes = map[string]string{"vm": "vm", "subvol": "subvol", "base": "vm", "basevol": "subvol"}
+
+// Rename a disk dataset of a guest to the disk of another guest, e.g. vm-100-disk-0 to vm-200-disk-0
+// or base-100-disk-0 to vm-200-disk-0
+func renameDisk(name string, newVMID int) string {
+	base := path.Base(name)
+	if match := diskPrefixRE.FindStringSubmatch(base); match != nil {
+		base = fmt.Sprintf("%s-%d-disk-%s", clonePrefixes[match[1]], newVMID, strings.TrimPrefix(base, match[0]))
+	}
+	return path.Join(path.Dir(name), base)
+}
+
+// Keys of the guest config which must not be copied to a clone
+var cloneSkippedKeys = map[string]bool{
+	"parent":   true, // the snapshots of PVE are not cloned
+	"lock":     true,
+	"onboot":   true,
+	"vmgenid":  true,
+	"template": true, // the clone of a template is a regular guest
+}
+
+// Generator of the SMBIOS UUID of a cloned VM, the guest OS must not see the UUID of the source
+var newUUID = randomUUID
+
+// Generate a random UUID of version 4
+func randomUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+var smbiosUUIDRE = regexp.MustCompile(`(^|,)uuid=[^,]*`)
+
+var netKeyRE = regexp.MustCompile(`^net[0-9]+$`)
+
+// Derive the config of a clone from the config of the source guest.
+// The SMBIOS UUID is regenerated. Volumes of the source guest are renamed by volumes, e.g. local-zfs:vm-100-disk-0 to local-zfs:vm-200-disk-0,
+// the lines with other volumes of the guest are dropped.
+func cloneConfig(config string, volumes map[string]string) (string, []string) {
+	var lines, dropped []string
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Sections of PVE snapshots and pending changes
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok || strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+			continue
+		}
+		if cloneSkippedKeys[key] {
+			continue
+		}
+		if key == "smbios1" {
+			value = smbiosUUIDRE.ReplaceAllString(value, "${1}uuid="+newUUID())
+		}
+		if netKeyRE.MatchString(key) {
+			value = strings.ReplaceAll(value, ",link_down=0", "")
+			if !strings.Contains(value, "link_down=1") {
+				value += ",link_down=1"
+			}
+		}
+		volume, options, _ := strings.Cut(value, ",")
+		if _, name, ok := strings.Cut(volume, ":"); ok && vmidRE.MatchString(name) {
+			newVolume, cloned := volumes[volume]
+			if !cloned {
+				dropped = append(dropped, line)
+				continue
+			}
+			value = newVolume
+			if options != "" {
+				value += "," + options
+			}
+		}
+		lines = append(lines, key+": "+value)
+	}
+	return strings.Join(lines, "\n") + "\n", dropped
+}
+
+// Get the datasets of the zfspool storages by storage ID
+func zfsStorages(configPath string) (map[string]string, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	storages := make(map[string]string)
+	var storage string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t"):
+			// Section header, e.g. 'zfspool: local-zfs'
+			storage = ""
+			if fields[0] == "zfspool:" && len(fields) == 2 {
+				storage = fields[1]
+			}
+		case storage != "" && fields[0] == "pool" && len(fields) == 2:
+			storages[storage] = fields[1]
+		}
+	}
+	return storages, scanner.Err()
+}
+
+// Destroy a clone created by cloneGuest: its disks and its config
+func destroyClone(ctx context.Context, e Exec, source VMSource, env environment, newVMID int) error {
+	guest, disks, err := findGuest(ctx, e, source, env, newVMID)
+	if err != nil {
+		return err
+	}
+	if guest.Status != "stopped" {
+		return fmt.Errorf("guest %d is %s, stop it before destroying", guest.VMID, guest.Status)
+	}
+	// Refuse to destroy disks which are not clones, e.g. the VMID is mistyped
+	origins := make(map[string]string)
+	for _, pool := range sortedPools(disks) {
+		output, err := command(ctx, e, "zfs", "list", "-H", "-o", "name,origin", "-r", pool)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			name, origin, _ := strings.Cut(line, "\t")
+			if vmidOf(name) == newVMID {
+				origins[name] = origin
+			}
+		}
+	}
+	for _, pool := range sortedPools(disks) {
+		for _, disk := range disks[pool] {
+			if origin := origins[disk.name]; origin == "" || origin == "-" {
+				return fmt.Errorf("%s is not a clone, refusing to destroy it", disk.name)
+			}
+		}
+	}
+	for _, pool := range sortedPools(disks) {
+		for _, disk := range disks[pool] {
+			if _, err := command(ctx, e, "zfs", "destroy", disk.name); err != nil {
+				return err
+			}
+			fmt.Printf("destroyed %s\n", disk.name)
+			holds, err := ZfsHolds(ctx, e, []string{origins[disk.name]})
+			if err != nil {
+				return err
+			}
+			if slices.Contains(holds[origins[disk.name]], cloneTag(newVMID)) {
+				if _, err := command(ctx, e, "zfs", "release", cloneTag(newVMID), origins[disk.name]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := os.Remove(guestConfigPath(env.hostname, guest.Type, newVMID)); err != nil {
+		return err
+	}
+	fmt.Printf("removed %s %d from node %s\n", guest.Type, newVMID, env.hostname)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRenameDisk(t *testing.T) {
+	tests := map[string]string{
+		"rpool/data/vm-100-disk-0":      "rpool/data/vm-200-disk-0",
+		"rpool/data/subvol-100-disk-1":  "rpool/data/subvol-200-disk-1",
+		"tank/vm-100-disk-10":           "tank/vm-200-disk-10",
+		"rpool/data/base-100-disk-0":    "rpool/data/vm-200-disk-0",
+		"rpool/data/basevol-100-disk-0": "rpool/data/subvol-200-disk-0",
+	}
+	for name, expected := range tests {
+		if got := renameDisk(name, 200); got != expected {
+			t.Errorf("renameDisk(%s) = %s, want %s", name, got, expected)
+		}
+	}
+}
+
+func TestCloneConfig(t *testing.T) {
+	original := newUUID
+	newUUID = func() string { return "5c1f3b7e-2a4d-4e6f-8a9b-0c1d2e3f4a5b" }
+	t.Cleanup(func() { newUUID = original })
+
+	config := `#web server
+boot: order=scsi0;net0
+lock: backup
+name: web
+net0: virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1
+net1: virtio=BC:24:11:00:00:02,bridge=vmbr1,link_down=0
+onboot: 1
+parent: before-upgrade
+scsi0: local-zfs:vm-100-disk-0,iothread=1,size=32G
+scsi1: local-lvm:vm-100-disk-0,size=8G
+ide2: local:iso/debian.iso,media=cdrom
+smbios1: uuid=7b2e9c1a-4f3d-4b8e-9a1c-2d3e4f5a6b7c,manufacturer=QEMU
+template: 1
+unused0: local-zfs:vm-100-disk-1
+vmgenid: 0b1e4f66-1d9e-4c1e-9a6a-1d1a2b3c4d5e
+
+[before-upgrade]
+scsi0: local-zfs:vm-100-disk-0,iothread=1,size=32G
+`
+	volumes := map[string]string{"local-zfs:vm-100-disk-0": "local-zfs:vm-200-disk-0", "local-zfs:vm-100-disk-1": "local-zfs:vm-200-disk-1"}
+	newConfig, dropped := cloneConfig(config, volumes)
+	expected := `#web server
+boot: order=scsi0;net0
+name: web
+net0: virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1,link_down=1
+net1: virtio=BC:24:11:00:00:02,bridge=vmbr1,link_down=1
+scsi0: local-zfs:vm-200-disk-0,iothread=1,size=32G
+ide2: local:iso/debian.iso,media=cdrom
+smbios1: uuid=5c1f3b7e-2a4d-4e6f-8a9b-0c1d2e3f4a5b,manufacturer=QEMU
+unused0: local-zfs:vm-200-disk-1
+
+`
+	if newConfig != expected {
+		t.Errorf("unexpected config:\n%s\nwant:\n%s", newConfig, expected)
+	}
+	// The volume has the name of a cloned disk, but it is on another storage
+	if !reflect.DeepEqual(dropped, []string{"scsi1: local-lvm:vm-100-disk-0,size=8G"}) {
+		t.Errorf("dropped = %v", dropped)
+	}
+}
+
+func TestRandomUUID(t *testing.T) {
+	uuid := randomUUID()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid) {
+		t.Errorf("randomUUID() = %s, not a version 4 UUID", uuid)
+	}
+	if uuid == randomUUID() {
+		t.Errorf("randomUUID() returned %s twice", uuid)
+	}
+}
+
+func TestZfsStorages(t *testing.T) {
+	storages, err := zfsStorages("testdata/storage.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"local-zfs": "rpool/data", "tank-zfs": "tank/pve"}
+	if !reflect.DeepEqual(storages, expected) {
+		t.Errorf("zfsStorages() = %v, want %v", storages, expected)
+	}
+}
+
+func newCloneTestDir(t *testing.T) string {
+	dir := t.TempDir()
+	originalNodes, originalStorage := pveNodesDir, pveStorageConfig
+	pveNodesDir, pveStorageConfig = dir, "testdata/storage.cfg"
+	t.Cleanup(func() { pveNodesDir, pveStorageConfig = originalNodes, originalStorage })
+	if err := os.MkdirAll(filepath.Join(dir, "HOST-1", "lxc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCloneGuest(t *testing.T) {
+	dir := newCloneTestDir(t)
+	config := "arch: amd64\nhostname: db\nnet0: name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:03,ip=dhcp,type=veth\nrootfs: local-zfs:subvol-101-disk-0,size=8G\n"
+	if err := os.WriteFile(filepath.Join(dir, "HOST-1", "lxc", "101.conf"), []byte(config), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs["zfs hold pve-zfs-snap-clone-300 rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly"] = nil
+	mockExec.Outputs["zfs clone rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly rpool/data/subvol-300-disk-0"] = nil
+
+	options := cloneOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", newVMID: 300}
+	if err := cloneGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options); err != nil {
+		t.Fatalf("cloneGuest returned error: %v", err)
+	}
+	newConfig, err := os.ReadFile(filepath.Join(dir, "HOST-1", "lxc", "300.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "arch: amd64\nhostname: db\nnet0: name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:03,ip=dhcp,type=veth,link_down=1\nrootfs: local-zfs:subvol-300-disk-0,size=8G\n"
+	if string(newConfig) != expected {
+		t.Errorf("unexpected config:\n%s\nwant:\n%s", newConfig, expected)
+	}
+
+	options.newVMID = 100
+	err = cloneGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options)
+	if err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected used VMID error, got %v", err)
+	}
+}
+
+func TestDestroyClone(t *testing.T) {
+	dir := newCloneTestDir(t)
+	configPath := filepath.Join(dir, "HOST-1", "lxc", "300.conf")
+	if err := os.WriteFile(configPath, []byte("rootfs: local-zfs:subvol-300-disk-0,size=8G\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs["pvesh get /cluster/resources --type vm --output-format json"] = []byte(
+		`[{"id": "lxc/300", "name": "db", "node": "HOST-1", "status": "stopped", "type": "lxc", "vmid": 300}]`)
+	mockExec.Outputs["zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r rpool"] = []byte(
+		"NAME  LABEL:NOSNAP  LABEL:RUNNING  WRITTEN  LABEL:SNAP-FREEZE\n" +
+			"rpool/data/subvol-300-disk-0  -  -  0  -\n")
+	origin := "rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly"
+	mockExec.Outputs["zfs list -H -o name,origin -r rpool"] = []byte(
+		"rpool\t-\nrpool/data/subvol-101-disk-0\t-\nrpool/data/subvol-300-disk-0\t" + origin + "\n")
+	mockExec.Outputs["zfs destroy rpool/data/subvol-300-disk-0"] = nil
+	mockExec.Outputs["zfs holds -H "+origin] = []byte(origin + "\tpve-zfs-snap-clone-300\tTue Jan 24 08:00 2023\n")
+	mockExec.Outputs["zfs release pve-zfs-snap-clone-300 "+origin] = nil
+	mockExec.Stdin = make(map[string][]byte)
+
+	if err := destroyClone(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), 300); err != nil {
+		t.Fatalf("destroyClone returned error: %v", err)
+	}
+	if _, ok := mockExec.Stdin["zfs release pve-zfs-snap-clone-300 "+origin]; !ok {
+		t.Errorf("the origin snapshot was not released")
+	}
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Errorf("the config was not removed: %v", err)
+	}
+
+	// Disks which are not clones are never destroyed
+	if err := os.WriteFile(configPath, []byte("rootfs: local-zfs:subvol-300-disk-0,size=8G\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	mockExec.Outputs["zfs list -H -o name,origin -r rpool"] = []byte("rpool/data/subvol-300-disk-0\t-\n")
+	err := destroyClone(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), 300)
+	if err == nil || !strings.Contains(err.Error(), "is not a clone") {
+		t.Errorf("expected not a clone error, got %v", err)
+	}
+}
@@ -15,19 +15,32 @@ func isTerminal() bool {
 	return term.IsTerminal(int(os.Stdout.Fd()))
 }
 
-func updateCron() {
+// A dry run only shows the plan, its parameters must not become a real run in cron
+func shouldUpdateCron(env environment) bool {
+	return !env.dryRun
+}
+
+func updateCron() error {
 	// Ваша команда и аргументы
 	executable := os.Args[0]
-	args := os.Args[1:]
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if !isOneShotOption(arg) {
+			args = append(args, arg)
+		}
+	}
 
 	// Сформируйте строку для добавления в cron
+	// Экранируем аргументы, например команды хуков с пробелами
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
 	command := fmt.Sprintf("*/15 * * * * %s %s", executable, strings.Join(args, " "))
 
 	// Чтение текущих заданий cron
 	out, err := exec.Command("crontab", "-l").Output()
 	if err != nil {
-		fmt.Println("Ошибка при получении текущих заданий cron:", err)
-		os.Exit(1)
+		return fmt.Errorf("ошибка при получении текущих заданий cron: %v", err)
 	}
 
 	lines := strings.Split(string(out), "\n")
@@ -57,9 +70,19 @@ func updateCron() {
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		os.Exit(1)
+		return fmt.Errorf("%v: %s", err, stderr.String())
 	}
 
 	fmt.Println("Задание cron обновлено.")
+	return nil
+}
+
+// Экранируем аргумент для shell, если в нем есть спецсимволы.
+// Символ % в cron означает перевод строки, поэтому его тоже экранируем
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=.,:/@+") == "" {
+		return arg
+	}
+	quoted := "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	return strings.ReplaceAll(quoted, "%", `\%`)
 }
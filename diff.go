@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type diffOptions struct {
+	vmid   int
+	from   string // snapshot name without the dataset
+	to     string // snapshot name without the dataset, "now" - the current state
+	output string
+}
+
+// Change of a file between two snapshots
+type diffRecord struct {
+	Disk    string    `json:"disk"`
+	Time    time.Time `json:"time"` // time of the inode change
+	Change  string    `json:"change"`
+	Type    string    `json:"type"`
+	Path    string    `json:"path"`               // path inside the container
+	NewPath string    `json:"new_path,omitempty"` // path after a rename
+}
+
+// Changes by the markers of zfs diff
+var diffChanges = map[string]string{
+	"+": "added",
+	"-": "removed",
+	"M": "modified",
+	"R": "renamed",
+}
+
+// File types by the markers of zfs diff -F
+var diffTypes = map[string]string{
+	"F": "file",
+	"/": "directory",
+	"@": "symlink",
+	"B": "block device",
+	"C": "character device",
+	"|": "pipe",
+	"=": "socket",
+	">": "door",
+	"P": "event port",
+}
+
+func (o *diffOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--vmid' requires a VMID")
+		}
+		o.vmid = vmid
+	case "from", "to":
+		if value == "" || strings.ContainsAny(value, "@/") {
+			return true, fmt.Errorf("option '--%s' requires a snapshot name without the dataset", name)
+		}
+		if name == "from" {
+			o.from = value
+		} else {
+			o.to = value
+		}
+	case "output":
+		if value != "table" && value != "json" {
+			return true, fmt.Errorf("option '--output' must be table or json")
+		}
+		o.output = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Show changed files of a container between two snapshots
+func diffCommand(ctx context.Context, e Exec, args []string) error {
+	options := diffOptions{to: "now", output: "table"}
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	if options.vmid == 0 || options.from == "" {
+		return &UsageError{fmt.Errorf("diff requires --vmid and --from")}
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	records, err := diffGuest(ctx, e, source, env, options)
+	if err != nil {
+		return err
+	}
+	return writeDiff(os.Stdout, records, options.output)
+}
+
+// Get the changes of all subvol disks of a container
+func diffGuest(ctx context.Context, e Exec, source VMSource, env environment, options diffOptions) ([]diffRecord, error) {
+	_, disks, err := findGuest(ctx, e, source, env, options.vmid)
+	if err != nil {
+		return nil, err
+	}
+	if !hasSubvol(disks) {
+		return nil, fmt.Errorf("guest %d has no subvol disks, diff works only for containers", options.vmid)
+	}
+	records := []diffRecord{}
+	for _, pool := range sortedPools(disks) {
+		for _, disk := range disks[pool] {
+			// zfs diff works only with file systems
+			if !strings.HasPrefix(path.Base(disk.name), "subvol-") {
+				continue
+			}
+			diskRecords, err := zfsDiff(ctx, e, disk.name, options.from, options.to)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, diskRecords...)
+		}
+	}
+	return records, nil
+}
+
+func hasSubvol(disks guestDisks) bool {
+	for _, poolDisks := range disks {
+		for _, disk := range poolDisks {
+			if strings.HasPrefix(path.Base(disk.name), "subvol-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run zfs diff for a dataset, to is "now" for the current state of the dataset
+func zfsDiff(ctx context.Context, e Exec, dataset string, from string, to string) ([]diffRecord, error) {
+	output, err := command(ctx, e, "zfs", "get", "-H", "-o", "value", "mountpoint", dataset)
+	if err != nil {
+		return nil, err
+	}
+	mountpoint := strings.TrimSpace(string(output))
+	target := dataset
+	if to != "now" {
+		target = dataset + "@" + to
+	}
+	output, err = command(ctx, e, "zfs", "diff", "-FHt", dataset+"@"+from, target)
+	if err != nil {
+		return nil, err
+	}
+	return parseZfsDiff(output, dataset, mountpoint)
+}
+
+// Parse the output of zfs diff -FHt: time, change, type, path and the new path of a rename
+func parseZfsDiff(output []byte, dataset string, mountpoint string) ([]diffRecord, error) {
+	var records []diffRecord
+	for _, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("unexpected zfs diff output: %q", line)
+		}
+		seconds, nanoseconds, _ := strings.Cut(fields[0], ".")
+		sec, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected zfs diff time: %q", line)
+		}
+		nsec, _ := strconv.ParseInt(nanoseconds, 10, 64)
+		record := diffRecord{
+			Disk:   dataset,
+			Time:   time.Unix(sec, nsec).UTC(),
+			Change: diffChanges[fields[1]],
+			Type:   diffTypes[fields[2]],
+			Path:   guestPath(unescapeDiffPath(fields[3]), mountpoint),
+		}
+		if record.Change == "" || record.Type == "" {
+			return nil, fmt.Errorf("unexpected zfs diff output: %q", line)
+		}
+		if len(fields) > 4 {
+			record.NewPath = guestPath(unescapeDiffPath(fields[4]), mountpoint)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Decode the \0ooo escapes which zfs diff uses for spaces and non-printable bytes
+func unescapeDiffPath(escaped string) string {
+	var b strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == '\\' && i+5 <= len(escaped) {
+			if c, err := strconv.ParseUint(escaped[i+1:i+5], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 4
+				continue
+			}
+		}
+		b.WriteByte(escaped[i])
+	}
+	return b.String()
+}
+
+// Get the path inside the container from the path on the host
+func guestPath(hostPath string, mountpoint string) string {
+	if hostPath == mountpoint {
+		return "/"
+	}
+	if strings.HasPrefix(hostPath, mountpoint+"/") {
+		return strings.TrimPrefix(hostPath, mountpoint)
+	}
+	return hostPath
+}
+
+func writeDiff(w io.Writer, records []diffRecord, output string) error {
+	if output == "json" {
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tCHANGE\tTYPE\tPATH\tDISK")
+	for _, record := range records {
+		name := record.Path
+		if record.NewPath != "" {
+			name += " -> " + record.NewPath
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+			record.Time.Format(time.RFC3339), record.Change, record.Type, name, record.Disk)
+	}
+	return writer.Flush()
+}
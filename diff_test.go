@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseZfsDiff(t *testing.T) {
+	output := "1674543602.123456789\tM\t/\t/rpool/data/subvol-101-disk-0/etc\n" +
+		"1674543602.223456789\t+\tF\t/rpool/data/subvol-101-disk-0/etc/new\\0040file\n" +
+		"1674543603.000000000\tR\tF\t/rpool/data/subvol-101-disk-0/etc/a\t/rpool/data/subvol-101-disk-0/etc/b\n" +
+		"1674543604.000000000\t-\t@\t/rpool/data/subvol-101-disk-0/lib64\n"
+	records, err := parseZfsDiff([]byte(output), "rpool/data/subvol-101-disk-0", "/rpool/data/subvol-101-disk-0")
+	if err != nil {
+		t.Fatalf("parseZfsDiff returned error: %v", err)
+	}
+	disk := "rpool/data/subvol-101-disk-0"
+	expected := []diffRecord{
+		{Disk: disk, Time: time.Unix(1674543602, 123456789).UTC(), Change: "modified", Type: "directory", Path: "/etc"},
+		{Disk: disk, Time: time.Unix(1674543602, 223456789).UTC(), Change: "added", Type: "file", Path: "/etc/new file"},
+		{Disk: disk, Time: time.Unix(1674543603, 0).UTC(), Change: "renamed", Type: "file", Path: "/etc/a", NewPath: "/etc/b"},
+		{Disk: disk, Time: time.Unix(1674543604, 0).UTC(), Change: "removed", Type: "symlink", Path: "/lib64"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("parseZfsDiff() = %+v, want %+v", records, expected)
+	}
+
+	if _, err := parseZfsDiff([]byte("1674543602.0\tX\tF\t/a\n"), disk, "/"); err == nil {
+		t.Errorf("expected error for an unknown change")
+	}
+}
+
+func TestDiffGuest(t *testing.T) {
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs["zfs get -H -o value mountpoint rpool/data/subvol-101-disk-0"] = []byte("/rpool/data/subvol-101-disk-0\n")
+	mockExec.Outputs["zfs diff -FHt rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly rpool/data/subvol-101-disk-0"] = []byte(
+		"1674543602.000000000\tM\tF\t/rpool/data/subvol-101-disk-0/etc/hosts\n")
+	env := runTestEnv(t)
+
+	records, err := diffGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, diffOptions{vmid: 101, from: "autosnap_2023-01-24_06:00:02_hourly", to: "now"})
+	if err != nil {
+		t.Fatalf("diffGuest returned error: %v", err)
+	}
+	var output bytes.Buffer
+	if err := writeDiff(&output, records, "table"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "TIME                  CHANGE    TYPE  PATH        DISK\n" +
+		"2023-01-24T07:00:02Z  modified  file  /etc/hosts  rpool/data/subvol-101-disk-0\n"
+	if output.String() != expected {
+		t.Errorf("unexpected diff:\n%s\nwant:\n%s", output.String(), expected)
+	}
+
+	_, err = diffGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, diffOptions{vmid: 100, from: "autosnap_2023-01-24_06:00:02_hourly", to: "now"})
+	if err == nil || !strings.Contains(err.Error(), "only for containers") {
+		t.Errorf("expected error for a VM, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes of the program
+const (
+	exitOK             = 0
+	exitFailure        = 1 // any other error, e.g. an aborting pre hook
+	exitUsage          = 2 // invalid parameters
+	exitDiscovery      = 3 // pools or guests could not be listed
+	exitPartialFailure = 4 // some pools failed, the others were processed
+	exitDestroyRefused = 5 // the destroy guard refused to prune, see --force-prune
+)
+
+// UsageError is an error in the parameters, help is shown for it
+type UsageError struct {
+	Err error
+}
+
+func (e *UsageError) Error() string { return e.Err.Error() }
+func (e *UsageError) Unwrap() error { return e.Err }
+
+// DiscoveryError is a failure to list pools or guests, nothing was changed
+type DiscoveryError struct {
+	Err error
+}
+
+func (e *DiscoveryError) Error() string { return fmt.Sprintf("discovery failed: %v", e.Err) }
+func (e *DiscoveryError) Unwrap() error { return e.Err }
+
+// PartialError is a failure of some pools, the other pools were processed
+type PartialError struct {
+	Err error
+}
+
+func (e *PartialError) Error() string { return e.Err.Error() }
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// Returned by Pending.Run when the destroy guard refuses to prune
+var errDestroyRefused = errors.New("refusing to destroy snapshots, use --force-prune to override")
+
+// Get the exit code of an error
+func exitCode(err error) int {
+	var usageErr *UsageError
+	var discoveryErr *DiscoveryError
+	var partialErr *PartialError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.As(err, &discoveryErr):
+		return exitDiscovery
+	case errors.As(err, &partialErr):
+		// Refusals only are reported separately, so monitoring can tell them from failures
+		if onlyDestroyRefused(partialErr.Err) {
+			return exitDestroyRefused
+		}
+		return exitPartialFailure
+	}
+	return exitFailure
+}
+
+// Check if all joined errors are refusals of the destroy guard
+func onlyDestroyRefused(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if !errors.Is(e, errDestroyRefused) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(err, errDestroyRefused)
+}
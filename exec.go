@@ -1,35 +1,150 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os/exec"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// Command to execute
+type Cmd struct {
+	Name    string
+	Args    []string
+	Stdin   []byte
+	Timeout time.Duration // 0 - the default timeout of the command
+}
+
+func (c Cmd) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Result of an executed command
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Error of a command which exited with a non-zero code
+type CommandError struct {
+	Cmd    Cmd
+	Result Result
+}
+
+func (e *CommandError) Error() string {
+	message := fmt.Sprintf("%s: exit status %d", e.Cmd, e.Result.ExitCode)
+	if stderr := strings.TrimSpace(string(e.Result.Stderr)); stderr != "" {
+		message += ": " + stderr
+	}
+	return message
+}
+
 type Exec interface {
-	Command(name string, arg ...string) ([]byte, error)
+	Run(ctx context.Context, cmd Cmd) (Result, error)
 }
 
+// Default timeouts by command name, so that a hung command does not block cron forever
+var defaultTimeouts = map[string]time.Duration{
+	"zfs":   10 * time.Minute,
+	"zpool": time.Minute,
+	"pvesh": time.Minute,
+	"qm":    time.Minute,
+	"pct":   time.Minute,
+}
+
+// How long a command may keep running after its context is done, or its pipes may stay open
+// after it exited, e.g. held by a background process of a hook
+const waitDelay = 5 * time.Second
+
 type OSExec struct{}
 
-func (e OSExec) Command(cmd string, arg ...string) ([]byte, error) {
-	return exec.Command(cmd, arg...).Output()
+func (e OSExec) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeouts[cmd.Name]
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	// The command gets its own process group, so that a timeout also kills its children,
+	// otherwise a child holding stdout blocks waiting for the command
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	c.WaitDelay = waitDelay
+	if cmd.Stdin != nil {
+		c.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	if errors.Is(err, exec.ErrWaitDelay) && ctx.Err() == nil {
+		// The command succeeded, a process it left behind kept the pipes open
+		err = nil
+	}
+	result := Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		if ctx.Err() != nil {
+			return result, fmt.Errorf("%s: %w", cmd, ctx.Err())
+		}
+		return result, &CommandError{Cmd: cmd, Result: result}
+	}
+	return result, err
+}
+
+// Run a command and return its stdout
+func command(ctx context.Context, e Exec, name string, arg ...string) ([]byte, error) {
+	result, err := e.Run(ctx, Cmd{Name: name, Args: arg})
+	return result.Stdout, err
 }
 
 type zfs struct {
-	name    string
-	nosnap  bool
-	running string
+	name     string
+	nosnap   bool
+	running  string
+	written  int64  // bytes written since the latest snapshot
+	freeze   bool   // label:snap-freeze=on
+	replica  string // why the dataset is a received replica, "" - not a replica
+	readonly bool   // readonly=on
 }
 
 type snapshot struct {
-	name     string
-	creation int64
+	name       string
+	creation   int64
+	userrefs   int64
+	used       int64
+	written    int64
+	createtxg  int64
+	referenced int64
+	holds      []string
+}
+
+// Check if a snapshot carries a hold with the given tag
+func (s snapshot) hasHold(tag string) bool {
+	for _, hold := range s.holds {
+		if hold == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // ZpoolList retrieves the list of ZFS pools
-func ZpoolList(e Exec) ([]string, error) {
-	bytes, err := e.Command("zpool", "list", "-H", "-o", "name")
+func ZpoolList(ctx context.Context, e Exec) ([]string, error) {
+	bytes, err := command(ctx, e, "zpool", "list", "-H", "-o", "name")
 	if err != nil {
 		return nil, err
 	}
@@ -41,9 +156,38 @@ func ZpoolList(e Exec) ([]string, error) {
 	return lines, nil
 }
 
+type poolSpace struct {
+	size     int64
+	free     int64
+	capacity int // percent
+}
+
+// ZpoolSpace retrieves size and free space of a ZFS pool
+func ZpoolSpace(ctx context.Context, e Exec, pool string) (poolSpace, error) {
+	bytes, err := command(ctx, e, "zpool", "list", "-H", "-p", "-o", "size,free,capacity", pool)
+	if err != nil {
+		return poolSpace{}, err
+	}
+	fields := strings.Fields(string(bytes))
+	if len(fields) != 3 {
+		return poolSpace{}, fmt.Errorf("unexpected zpool list output: %q", bytes)
+	}
+	var space poolSpace
+	if space.size, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return poolSpace{}, err
+	}
+	if space.free, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return poolSpace{}, err
+	}
+	if space.capacity, err = strconv.Atoi(strings.TrimSuffix(fields[2], "%")); err != nil {
+		return poolSpace{}, err
+	}
+	return space, nil
+}
+
 // ZFSlist retrieves ZFS datasets with specific properties
-func ZFSlist(e Exec, pool string) ([]zfs, error) {
-	bytes, err := e.Command("zfs", "list", "-o", "name,label:nosnap,label:running", "-r", pool)
+func ZFSlist(ctx context.Context, e Exec, pool string) ([]zfs, error) {
+	bytes, err := command(ctx, e, "zfs", "list", "-p", "-o", "name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role", "-r", pool)
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +195,16 @@ func ZFSlist(e Exec, pool string) ([]zfs, error) {
 	if len(table) == 0 {
 		return []zfs{}, nil
 	}
+	// The source of readonly tells a received dataset from one set readonly locally
+	var readonlySources map[string]string
+	for _, line := range table[1:] {
+		if len(line) > 5 && line[5] == "on" {
+			if readonlySources, err = ZfsReadonlySources(ctx, e, pool); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
 	zfsList := make([]zfs, len(table)-1)
 	for i, line := range table[1:] {
 		nosnap := false
@@ -61,38 +215,139 @@ func ZFSlist(e Exec, pool string) ([]zfs, error) {
 		if len(line) > 2 {
 			running = line[2]
 		}
+		var written int64
+		if len(line) > 3 {
+			// A wrong 0 would look like an unchanged dataset and skip its snapshots
+			if written, err = strconv.ParseInt(line[3], 10, 64); err != nil {
+				return nil, fmt.Errorf("unexpected written of %s: %q", line[0], line[3])
+			}
+		}
 		zfsList[i] = zfs{
-			name:    line[0],
-			nosnap:  nosnap,
-			running: running,
+			name:     line[0],
+			nosnap:   nosnap,
+			running:  running,
+			written:  written,
+			freeze:   len(line) > 4 && line[4] == "on",
+			replica:  replicaOf(line, readonlySources[line[0]]),
+			readonly: len(line) > 5 && line[5] == "on",
 		}
 	}
 	return zfsList, nil
 }
 
+// ZfsReadonlySources retrieves the sources of readonly of the datasets of a pool,
+// e.g. local, received or inherited from <dataset>
+func ZfsReadonlySources(ctx context.Context, e Exec, pool string) (map[string]string, error) {
+	bytes, err := command(ctx, e, "zfs", "get", "-H", "-o", "name,source", "-t", "filesystem,volume", "-r", "readonly", pool)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(bytes)), "\n") {
+		if name, source, ok := strings.Cut(line, "\t"); ok {
+			sources[name] = source
+		}
+	}
+	return sources, nil
+}
+
 // ZfsListSnapshots retrieves snapshots of a ZFS dataset
-func ZfsListSnapshots(e Exec, zfs string) ([]snapshot, error) {
-	bytes, err := e.Command("zfs", "list", "-p", "-o", "name,creation", "-t", "snapshot", zfs)
+func ZfsListSnapshots(ctx context.Context, e Exec, zfs string) ([]snapshot, error) {
+	snapshots, err := zfsListSnapshots(ctx, e, zfs, false)
 	if err != nil {
 		return nil, err
 	}
-	if len(bytes) == 0 {
-		return nil, nil
+	return snapshots[zfs], nil
+}
+
+// ZfsListPoolSnapshots retrieves snapshots of all datasets of a pool with one zfs call
+func ZfsListPoolSnapshots(ctx context.Context, e Exec, pool string) (map[string][]snapshot, error) {
+	return zfsListSnapshots(ctx, e, pool, true)
+}
+
+// Retrieve snapshots grouped by dataset
+func zfsListSnapshots(ctx context.Context, e Exec, zfs string, recursive bool) (map[string][]snapshot, error) {
+	args := []string{"list", "-H", "-p", "-o", "name,creation,userrefs,used,written,createtxg,referenced", "-s", "createtxg", "-t", "snapshot"}
+	if recursive {
+		args = append(args, "-r")
 	}
-	table := SplitTable(bytes)
-	if len(table) <= 1 {
-		return nil, nil
+	bytes, err := command(ctx, e, "zfs", append(args, zfs)...)
+	if err != nil {
+		return nil, err
 	}
-	snapshots := make([]snapshot, len(table)-1)
-	for i, line := range table[1:] {
-		epoc, err := strconv.ParseInt(line[1], 10, 64)
-		if err != nil {
-			return nil, err
+	var all []snapshot
+	for _, line := range strings.Split(string(bytes), "\n") {
+		if line == "" {
+			continue
 		}
-		snapshots[i] = snapshot{
-			name:     line[0],
-			creation: epoc,
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("unexpected zfs list output: %q", line)
+		}
+		var numbers [6]int64
+		for j := range numbers {
+			numbers[j], err = strconv.ParseInt(fields[j+1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
 		}
+		all = append(all, snapshot{
+			name:       fields[0],
+			creation:   numbers[0],
+			userrefs:   numbers[1],
+			used:       numbers[2],
+			written:    numbers[3],
+			createtxg:  numbers[4],
+			referenced: numbers[5],
+		})
+	}
+	all, err = fillHolds(ctx, e, all)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make(map[string][]snapshot)
+	for _, snapshot := range all {
+		dataset, _, _ := strings.Cut(snapshot.name, "@")
+		snapshots[dataset] = append(snapshots[dataset], snapshot)
+	}
+	return snapshots, nil
+}
+
+// ZfsHolds retrieves hold tags of the given snapshots
+func ZfsHolds(ctx context.Context, e Exec, names []string) (map[string][]string, error) {
+	holds := make(map[string][]string)
+	if len(names) == 0 {
+		return holds, nil
+	}
+	bytes, err := command(ctx, e, "zfs", append([]string{"holds", "-H"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	// Timestamp column contains spaces, so split by tabs
+	for _, line := range strings.Split(strings.TrimSpace(string(bytes)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		holds[fields[0]] = append(holds[fields[0]], fields[1])
+	}
+	return holds, nil
+}
+
+// Fill hold tags for snapshots which have user references
+func fillHolds(ctx context.Context, e Exec, snapshots []snapshot) ([]snapshot, error) {
+	var held []string
+	for _, snapshot := range snapshots {
+		if snapshot.userrefs > 0 {
+			held = append(held, snapshot.name)
+		}
+	}
+	holds, err := ZfsHolds(ctx, e, held)
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		snapshots[i].holds = holds[snapshots[i].name]
 	}
 	return snapshots, nil
 }
@@ -1,26 +1,49 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type MockExec struct {
 	Outputs map[string][]byte
 	Errors  map[string]error
+	// Scripted stdout, stderr and exit code
+	Results map[string]Result
+	// Stdin passed to the commands
+	Stdin map[string][]byte
+	mu    sync.Mutex
 }
 
-func (m *MockExec) Command(name string, arg ...string) ([]byte, error) {
-	key := name + " " + strings.Join(arg, " ")
+func (m *MockExec) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	key := cmd.String()
+	m.mu.Lock()
+	if m.Stdin != nil {
+		m.Stdin[key] = cmd.Stdin
+	}
+	m.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
 	if err, ok := m.Errors[key]; ok {
-		return nil, err
+		return Result{}, err
+	}
+	if result, ok := m.Results[key]; ok {
+		if result.ExitCode != 0 {
+			return result, &CommandError{Cmd: cmd, Result: result}
+		}
+		return result, nil
 	}
 	if output, ok := m.Outputs[key]; ok {
-		return output, nil
+		return Result{Stdout: output}, nil
 	}
-	return nil, fmt.Errorf("command not found: %s", key)
+	return Result{}, fmt.Errorf("command not found: %s", key)
 }
 
 func TestGetVMs(t *testing.T) {
@@ -75,7 +98,7 @@ func TestGetVMs(t *testing.T) {
 
 	node := "AX101-Hels-03"
 
-	vms, err := GetVMs(mockExec, node)
+	vms, err := GetVMs(context.Background(), mockExec, node)
 	if err != nil {
 		t.Fatalf("GetVMs returned error: %v", err)
 	}
@@ -117,7 +140,7 @@ func TestZpoolList(t *testing.T) {
 		},
 	}
 
-	zpools, err := ZpoolList(mockExec)
+	zpools, err := ZpoolList(context.Background(), mockExec)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -132,23 +155,39 @@ func TestZFSlist(t *testing.T) {
 	pool := "rpool"
 	mockExec := &MockExec{
 		Outputs: map[string][]byte{
-			"zfs list -o name,label:nosnap,label:running -r rpool": []byte(
-				"NAME                          LABEL:NOSNAP  LABEL:RUNNING\n" +
-					"rpool                         -             -\n" +
-					"rpool/ROOT                    nosnap        stopped\n" +
-					"rpool/data/subvol-952-disk-0  -             HOST-1\n"),
+			"zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r rpool": []byte(
+				"NAME                          LABEL:NOSNAP  LABEL:RUNNING  WRITTEN  LABEL:SNAP-FREEZE  RDONLY  RECEIVE_RESUME_TOKEN  LABEL:ROLE\n" +
+					"rpool                         -             -              0        -                  off     -                     -\n" +
+					"rpool/ROOT                    nosnap        stopped        4096     -                  off     -                     -\n" +
+					"rpool/data/subvol-952-disk-0  -             HOST-1         123456   on                 off     -                     -\n" +
+					"rpool/data/vm-953-disk-0      -             -              0        -                  on      -                     -\n" +
+					"rpool/data/vm-954-disk-0      -             -              0        -                  off     1-e5d4b2a4c-c0-789c   -\n" +
+					"rpool/data/vm-955-disk-0      -             -              0        -                  off     -                     replica\n" +
+					"rpool/data/vm-956-disk-0      -             -              0        -                  on      -                     -\n"),
+			"zfs get -H -o name,source -t filesystem,volume -r readonly rpool": []byte(
+				"rpool\tdefault\n" +
+					"rpool/ROOT\tdefault\n" +
+					"rpool/data/subvol-952-disk-0\tdefault\n" +
+					"rpool/data/vm-953-disk-0\treceived\n" +
+					"rpool/data/vm-954-disk-0\tdefault\n" +
+					"rpool/data/vm-955-disk-0\tdefault\n" +
+					"rpool/data/vm-956-disk-0\tlocal\n"),
 		},
 	}
 
-	zfsList, err := ZFSlist(mockExec, pool)
+	zfsList, err := ZFSlist(context.Background(), mockExec, pool)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
 	expectedZfsList := []zfs{
 		{name: "rpool", nosnap: false, running: "-"},
-		{name: "rpool/ROOT", nosnap: true, running: "stopped"},
-		{name: "rpool/data/subvol-952-disk-0", nosnap: false, running: "HOST-1"},
+		{name: "rpool/ROOT", nosnap: true, running: "stopped", written: 4096},
+		{name: "rpool/data/subvol-952-disk-0", nosnap: false, running: "HOST-1", written: 123456, freeze: true},
+		{name: "rpool/data/vm-953-disk-0", running: "-", replica: "readonly (received)", readonly: true},
+		{name: "rpool/data/vm-954-disk-0", running: "-", replica: "receiving"},
+		{name: "rpool/data/vm-955-disk-0", running: "-", replica: "label:role=replica"},
+		{name: "rpool/data/vm-956-disk-0", running: "-", readonly: true},
 	}
 
 	if !reflect.DeepEqual(zfsList, expectedZfsList) {
@@ -160,24 +199,162 @@ func TestZfsListSnapshots(t *testing.T) {
 	zfs := "pool1/dataset1"
 	mockExec := &MockExec{
 		Outputs: map[string][]byte{
-			"zfs list -p -o name,creation -t snapshot pool1/dataset1": []byte(
-				"NAME                                                          CREATION\n" +
-					"pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly  1697709600\n" +
-					"pool1/dataset1@autosnap_2023-10-19_11:00:03_hourly  1697713203\n"),
+			"zfs list -H -p -o name,creation,userrefs,used,written,createtxg,referenced -s createtxg -t snapshot pool1/dataset1": []byte(
+				"pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly\t1697709600\t0\t0\t4096\t1001\t0\n" +
+					"pool1/dataset1@autosnap_2023-10-19_11:00:03_hourly\t1697713203\t0\t8192\t8192\t1002\t65536\n"),
 		},
 	}
 
-	snapshots, err := ZfsListSnapshots(mockExec, zfs)
+	snapshots, err := ZfsListSnapshots(context.Background(), mockExec, zfs)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
 	expectedSnapshots := []snapshot{
-		{name: "pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly", creation: 1697709600},
-		{name: "pool1/dataset1@autosnap_2023-10-19_11:00:03_hourly", creation: 1697713203},
+		{name: "pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly", creation: 1697709600, written: 4096, createtxg: 1001},
+		{name: "pool1/dataset1@autosnap_2023-10-19_11:00:03_hourly", creation: 1697713203, used: 8192, written: 8192, createtxg: 1002, referenced: 65536},
 	}
 
 	if !reflect.DeepEqual(snapshots, expectedSnapshots) {
 		t.Errorf("unexpected snapshots: got %v, want %v", snapshots, expectedSnapshots)
 	}
 }
+
+func TestZfsListSnapshotsHolds(t *testing.T) {
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			"zfs list -H -p -o name,creation,userrefs,used,written,createtxg,referenced -s createtxg -t snapshot pool1/dataset1": []byte(
+				"pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly\t1697709600\t2\t0\t0\t1001\t0\n" +
+					"pool1/dataset1@autosnap_2023-10-19_11:00:03_hourly\t1697713203\t0\t8192\t8192\t1002\t0\n"),
+			"zfs holds -H pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly": []byte(
+				"pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly\tpve-zfs-snap-keep\tThu Oct 19 10:00 2023\n" +
+					"pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly\tpve-zfs-snap-pin\tThu Oct 19 10:05 2023\n"),
+		},
+	}
+
+	snapshots, err := ZfsListSnapshots(context.Background(), mockExec, "pool1/dataset1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expectedSnapshots := []snapshot{
+		{name: "pool1/dataset1@autosnap_2023-10-19_10:00:00_hourly", creation: 1697709600, userrefs: 2, createtxg: 1001, holds: []string{keepTag, pinTag}},
+		{name: "pool1/dataset1@autosnap_2023-10-19_11:00:03_hourly", creation: 1697713203, used: 8192, written: 8192, createtxg: 1002},
+	}
+
+	if !reflect.DeepEqual(snapshots, expectedSnapshots) {
+		t.Errorf("unexpected snapshots: got %v, want %v", snapshots, expectedSnapshots)
+	}
+}
+
+func TestZfsListPoolSnapshots(t *testing.T) {
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			"zfs list -H -p -o name,creation,userrefs,used,written,createtxg,referenced -s createtxg -t snapshot -r rpool": []byte(
+				"rpool/data/vm-100-disk-0@autosnap_2023-10-19_10:00:00_hourly\t1697709600\t0\t0\t0\t1001\t0\n" +
+					"rpool/data/vm-101-disk-0@autosnap_2023-10-19_10:00:00_hourly\t1697709600\t0\t0\t0\t1001\t0\n" +
+					"rpool/data/vm-100-disk-0@autosnap_2023-10-19_11:00:00_hourly\t1697713200\t0\t0\t0\t1002\t0\n"),
+		},
+	}
+
+	snapshots, err := ZfsListPoolSnapshots(context.Background(), mockExec, "rpool")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]snapshot{
+		"rpool/data/vm-100-disk-0": {
+			{name: "rpool/data/vm-100-disk-0@autosnap_2023-10-19_10:00:00_hourly", creation: 1697709600, createtxg: 1001},
+			{name: "rpool/data/vm-100-disk-0@autosnap_2023-10-19_11:00:00_hourly", creation: 1697713200, createtxg: 1002},
+		},
+		"rpool/data/vm-101-disk-0": {
+			{name: "rpool/data/vm-101-disk-0@autosnap_2023-10-19_10:00:00_hourly", creation: 1697709600, createtxg: 1001},
+		},
+	}
+	if !reflect.DeepEqual(snapshots, expected) {
+		t.Errorf("unexpected snapshots: got %v, want %v", snapshots, expected)
+	}
+}
+
+// Synthetic listing of 100k snapshots: 1000 disks with 100 snapshots each
+func BenchmarkZfsListPoolSnapshots(b *testing.B) {
+	var listing strings.Builder
+	for disk := 0; disk < 1000; disk++ {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(&listing, "rpool/data/vm-%d-disk-0@autosnap_2023-10-19_10:%02d:00_frequently\t%d\t0\t4096\t8192\t%d\t65536\n",
+				100+disk, i%60, 1697709600+i*900, 1000+i)
+		}
+	}
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			"zfs list -H -p -o name,creation,userrefs,used,written,createtxg,referenced -s createtxg -t snapshot -r rpool": []byte(listing.String()),
+		},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ZfsListPoolSnapshots(context.Background(), mockExec, "rpool"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMockExecResults(t *testing.T) {
+	mockExec := &MockExec{
+		Results: map[string]Result{
+			"zpool list -H -o name": {Stderr: []byte("failed to initialize ZFS library\n"), ExitCode: 1},
+		},
+	}
+	_, err := ZpoolList(context.Background(), mockExec)
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.Result.ExitCode != 1 {
+		t.Fatalf("expected CommandError, got %v", err)
+	}
+	if err.Error() != "zpool list -H -o name: exit status 1: failed to initialize ZFS library" {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestOSExec(t *testing.T) {
+	e := OSExec{}
+	result, err := e.Run(context.Background(), Cmd{
+		Name:  "sh",
+		Args:  []string{"-c", "cat; echo oops >&2; exit 3"},
+		Stdin: []byte("hello"),
+	})
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("expected CommandError, got %v", err)
+	}
+	expected := Result{Stdout: []byte("hello"), Stderr: []byte("oops\n"), ExitCode: 3}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Run() = %+v, want %+v", result, expected)
+	}
+
+	_, err = e.Run(context.Background(), Cmd{Name: "sleep", Args: []string{"5"}, Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// A child holding stdout is killed with the command
+	start := time.Now()
+	_, err = e.Run(context.Background(), Cmd{Name: "sh", Args: []string{"-c", "sleep 5 & sleep 5"}, Timeout: 50 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Run() returned after %v, the child was not killed", elapsed)
+	}
+}
+
+func TestZFSlistInvalidWritten(t *testing.T) {
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			"zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r rpool": []byte(
+				"NAME                      LABEL:NOSNAP  LABEL:RUNNING  WRITTEN\n" +
+					"rpool/data/vm-100-disk-0  -             HOST-1         4k\n"),
+		},
+	}
+	if _, err := ZFSlist(context.Background(), mockExec, "rpool"); err == nil {
+		t.Errorf("ZFSlist accepted written '4k'")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Pools and datasets a run is limited to
+type datasetFilter struct {
+	pools        []string // only these pools, empty - all imported pools
+	excludePools []string
+	include      []string // globs of datasets, empty - all datasets
+	exclude      []string
+}
+
+// Config file with the filters, so that backup pools stay excluded whatever the command line is
+var filterConfigFile = "/etc/pve-zfs-snap.conf"
+
+// Set a filter option, ok is false if the name is not a filter
+func (f *datasetFilter) setOption(arg string, name string, value string) (ok bool, err error) {
+	switch name {
+	case "pool":
+		return true, parsePoolsOption(arg, value, &f.pools)
+	case "exclude-pool":
+		return true, parsePoolsOption(arg, value, &f.excludePools)
+	case "include-dataset":
+		return true, parseGlobsOption(arg, value, &f.include)
+	case "exclude-dataset":
+		return true, parseGlobsOption(arg, value, &f.exclude)
+	}
+	return false, nil
+}
+
+// Read the filters of a config file. Lines are the filter options without '--', e.g. 'exclude-pool=backup',
+// empty lines and lines starting with '#' are skipped. A missing file sets no filters.
+func (f *datasetFilter) readConfig(path string) error {
+	config, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(config), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, "=")
+		arg := fmt.Sprintf("%s:%d: %s", path, i+1, name)
+		ok, err := f.setOption(arg, strings.TrimSpace(name), strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: unknown filter", arg)
+		}
+	}
+	return nil
+}
+
+// Parse a comma separated list of pools, the option may be repeated
+func parsePoolsOption(arg string, value string, target *[]string) error {
+	for _, pool := range strings.Split(value, ",") {
+		if pool == "" || strings.ContainsAny(pool, "/@") {
+			return fmt.Errorf("option '%s' has invalid pool '%s'", arg, pool)
+		}
+		*target = append(*target, pool)
+	}
+	return nil
+}
+
+// Parse a comma separated list of dataset globs, the option may be repeated
+func parseGlobsOption(arg string, value string, target *[]string) error {
+	for _, glob := range strings.Split(value, ",") {
+		if _, err := path.Match(glob, ""); glob == "" || err != nil {
+			return fmt.Errorf("option '%s' has invalid glob '%s'", arg, glob)
+		}
+		*target = append(*target, glob)
+	}
+	return nil
+}
+
+// Get the pools selected by --pool and --exclude-pool and the selected pools which are not imported
+func (f datasetFilter) filterPools(pools []string) ([]string, []string) {
+	var selected, missing []string
+	for _, pool := range pools {
+		if (len(f.pools) == 0 || slices.Contains(f.pools, pool)) && !slices.Contains(f.excludePools, pool) {
+			selected = append(selected, pool)
+		}
+	}
+	for _, pool := range f.pools {
+		if !slices.Contains(pools, pool) {
+			missing = append(missing, pool)
+		}
+	}
+	return selected, missing
+}
+
+// Report the selected pools which are not imported
+func logMissingPools(missing []string) {
+	for _, pool := range missing {
+		fmt.Printf("pool %s is not imported, skipping it\n", pool)
+	}
+}
+
+// Get the datasets selected by --include-dataset and --exclude-dataset
+func (f datasetFilter) filterDatasets(zfsList []zfs) []zfs {
+	var filtered []zfs
+	for _, zfs := range zfsList {
+		if (len(f.include) == 0 || matchDataset(f.include, zfs.name)) && !matchDataset(f.exclude, zfs.name) {
+			filtered = append(filtered, zfs)
+		}
+	}
+	return filtered
+}
+
+// Check whether a glob matches the dataset or one of its parents,
+// so 'tank/backup' selects every dataset under tank/backup
+func matchDataset(globs []string, name string) bool {
+	for _, glob := range globs {
+		for parent := name; parent != "." && parent != "/"; parent = path.Dir(parent) {
+			if ok, _ := path.Match(glob, parent); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
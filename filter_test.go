@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFilterPools(t *testing.T) {
+	tests := []struct {
+		filter   datasetFilter
+		selected []string
+		missing  []string
+	}{
+		{datasetFilter{}, []string{"rpool", "tank", "backup"}, nil},
+		{datasetFilter{pools: []string{"rpool", "fast"}}, []string{"rpool"}, []string{"fast"}},
+		{datasetFilter{excludePools: []string{"backup"}}, []string{"rpool", "tank"}, nil},
+		{datasetFilter{pools: []string{"rpool", "backup"}, excludePools: []string{"backup"}}, []string{"rpool"}, nil},
+	}
+	for _, test := range tests {
+		selected, missing := test.filter.filterPools([]string{"rpool", "tank", "backup"})
+		if !reflect.DeepEqual(selected, test.selected) || !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("filterPools(%+v) = %v, %v, want %v, %v", test.filter, selected, missing, test.selected, test.missing)
+		}
+	}
+}
+
+func TestFilterDatasets(t *testing.T) {
+	zfsList := []zfs{
+		{name: "rpool/data/vm-100-disk-0"},
+		{name: "rpool/data/subvol-101-disk-0"},
+		{name: "tank/backup/vm-100-disk-0"},
+	}
+	tests := []struct {
+		filter   datasetFilter
+		expected []string
+	}{
+		{datasetFilter{}, []string{"rpool/data/vm-100-disk-0", "rpool/data/subvol-101-disk-0", "tank/backup/vm-100-disk-0"}},
+		{datasetFilter{exclude: []string{"tank/backup"}}, []string{"rpool/data/vm-100-disk-0", "rpool/data/subvol-101-disk-0"}},
+		{datasetFilter{include: []string{"*/data/vm-*"}}, []string{"rpool/data/vm-100-disk-0"}},
+		{datasetFilter{include: []string{"rpool"}, exclude: []string{"*/*/subvol-*"}}, []string{"rpool/data/vm-100-disk-0"}},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, zfs := range test.filter.filterDatasets(zfsList) {
+			names = append(names, zfs.name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("filterDatasets(%+v) = %v, want %v", test.filter, names, test.expected)
+		}
+	}
+}
+
+func TestParseFilterOptions(t *testing.T) {
+	env, err := getEnvironment([]string{"pve-zfs-snap", "h1", "--pool=rpool,tank", "--pool=fast", "--exclude-dataset=tank/backup"})
+	if err != nil {
+		t.Fatalf("getEnvironment returned error: %v", err)
+	}
+	expected := datasetFilter{pools: []string{"rpool", "tank", "fast"}, exclude: []string{"tank/backup"}}
+	if !reflect.DeepEqual(env.filter, expected) {
+		t.Errorf("filter = %+v, want %+v", env.filter, expected)
+	}
+	for _, arg := range []string{"--pool=rpool/data", "--exclude-pool=", "--include-dataset=rpool/[", "--exclude-dataset=a,,b"} {
+		if _, err := getEnvironment([]string{"pve-zfs-snap", "h1", arg}); err == nil {
+			t.Errorf("getEnvironment accepted %s", arg)
+		}
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	original := filterConfigFile
+	filterConfigFile = filepath.Join(t.TempDir(), "pve-zfs-snap.conf")
+	t.Cleanup(func() { filterConfigFile = original })
+	config := "# receive pools\n" +
+		"exclude-pool = backup,offsite\n" +
+		"\n" +
+		"exclude-dataset=tank/scratch\n"
+	if err := os.WriteFile(filterConfigFile, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line adds to the config
+	env, err := getEnvironment([]string{"pve-zfs-snap", "h1", "--exclude-pool=archive", "--include-dataset=*/data/vm-*"})
+	if err != nil {
+		t.Fatalf("getEnvironment returned error: %v", err)
+	}
+	expected := datasetFilter{
+		excludePools: []string{"backup", "offsite", "archive"},
+		include:      []string{"*/data/vm-*"},
+		exclude:      []string{"tank/scratch"},
+	}
+	if !reflect.DeepEqual(env.filter, expected) {
+		t.Errorf("filter = %+v, want %+v", env.filter, expected)
+	}
+
+	for _, config := range []string{"pool=tank/data\n", "parallel=2\n"} {
+		if err := os.WriteFile(filterConfigFile, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getEnvironment([]string{"pve-zfs-snap", "h1"}); exitCode(err) != exitUsage {
+			t.Errorf("config %q: expected a usage error, got %v", config, err)
+		}
+	}
+}
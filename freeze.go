@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const freezeTag = "snap-freeze"
+
+// Guests whose filesystems are frozen with the QEMU guest agent during snapshots
+type freezePolicy struct {
+	all     bool
+	vmids   map[int]bool
+	timeout int // seconds
+}
+
+func parseFreezeOption(arg string, value string, target *freezePolicy) error {
+	if value == "all" {
+		target.all = true
+		return nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		vmid, err := strconv.Atoi(item)
+		if err != nil {
+			return fmt.Errorf("option '%s' has invalid VMID '%s'", arg, item)
+		}
+		target.vmids[vmid] = true
+	}
+	return nil
+}
+
+// Check if a guest has a tag
+func (vm VM) hasTag(tag string) bool {
+	for _, t := range strings.FieldsFunc(vm.Tags, func(r rune) bool { return r == ';' || r == ',' || r == ' ' }) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Get running QEMU VMs which opted in to freezing and have pending snapshots on any pool.
+// The opt in is the --freeze option, the snap-freeze tag or label:snap-freeze=on on a disk.
+func freezeVMIDs(vms []VM, pendings []*Pending, policy freezePolicy) []int {
+	snapshotted := make(map[int]bool)
+	labeled := make(map[int]bool)
+	for _, pending := range pendings {
+		for _, name := range pending.Snapshots {
+			snapshotted[vmidOf(name)] = true
+		}
+		for _, vmid := range pending.freezeLabeled {
+			labeled[vmid] = true
+		}
+	}
+	var vmids []int
+	for _, vm := range vms {
+		if vm.Type != "qemu" || vm.Status != "running" || !snapshotted[vm.VMID] {
+			continue
+		}
+		if policy.all || policy.vmids[vm.VMID] || labeled[vm.VMID] || vm.hasTag(freezeTag) {
+			vmids = append(vmids, vm.VMID)
+		}
+	}
+	sort.Ints(vmids)
+	return vmids
+}
+
+// Run a guest agent command with a strict timeout, so that a hung agent does not block the run
+func guestCommand(ctx context.Context, e Exec, vmid int, timeout int, command string) error {
+	_, err := e.Run(ctx, Cmd{
+		Name:    "qm",
+		Args:    []string{"guest", "cmd", strconv.Itoa(vmid), command},
+		Timeout: time.Duration(timeout) * time.Second,
+	})
+	return err
+}
+
+// Run a guest agent command on all guests concurrently, so that the freeze window
+// is bounded by one timeout whatever the number of guests is. Errors are returned in the order of vmids.
+func guestCommandAll(ctx context.Context, e Exec, vmids []int, timeout int, command string) []error {
+	errs := make([]error, len(vmids))
+	var wg sync.WaitGroup
+	for i, vmid := range vmids {
+		wg.Add(1)
+		go func(i int, vmid int) {
+			defer wg.Done()
+			errs[i] = guestCommand(ctx, e, vmid, timeout, command)
+		}(i, vmid)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Freeze guests, run fn and thaw the guests on any path.
+// A guest which failed to freeze is snapshotted crash-consistent.
+func withFrozen(ctx context.Context, e Exec, vmids []int, timeout int, fn func() error) error {
+	defer func() {
+		// Thaw even guests which failed to freeze, the freeze may have been partial
+		for i, err := range guestCommandAll(ctx, e, vmids, timeout, "fsfreeze-thaw") {
+			if err != nil {
+				fmt.Printf("failed to thaw VM %d: %v\n", vmids[i], err)
+			}
+		}
+	}()
+	for i, err := range guestCommandAll(ctx, e, vmids, timeout, "fsfreeze-freeze") {
+		if err != nil {
+			fmt.Printf("failed to freeze VM %d, the snapshot is crash-consistent: %v\n", vmids[i], err)
+		}
+	}
+	return fn()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records commands and fails those listed in Errors, commands may run concurrently
+type recordingExec struct {
+	mu       sync.Mutex
+	Commands []string
+	Errors   map[string]error
+}
+
+func (r *recordingExec) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	key := cmd.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Commands = append(r.Commands, key)
+	return Result{}, r.Errors[key]
+}
+
+func TestFreezeVMIDs(t *testing.T) {
+	vms := []VM{
+		{VMID: 100, Type: "qemu", Status: "running"},
+		{VMID: 101, Type: "qemu", Status: "running", Tags: "prod;snap-freeze"},
+		{VMID: 102, Type: "qemu", Status: "running"},
+		{VMID: 103, Type: "lxc", Status: "running", Tags: "snap-freeze"},
+		{VMID: 104, Type: "qemu", Status: "running"},
+	}
+	pendings := []*Pending{
+		{Snapshots: []string{"rpool/vm-100-disk-0@s", "rpool/vm-101-disk-0@s"}},
+		{Snapshots: []string{"tank/vm-102-disk-1@s", "tank/subvol-103-disk-0@s"}, freezeLabeled: []int{102}},
+	}
+	policy := freezePolicy{vmids: map[int]bool{100: true, 104: true}}
+	got := freezeVMIDs(vms, pendings, policy)
+	expected := []int{100, 101, 102}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("freezeVMIDs() = %v, want %v", got, expected)
+	}
+}
+
+func TestWithFrozenThawsOnError(t *testing.T) {
+	e := &recordingExec{Errors: map[string]error{
+		"qm guest cmd 101 fsfreeze-freeze": fmt.Errorf("timeout"),
+	}}
+	var frozen []string
+	err := withFrozen(context.Background(), e, []int{100, 101}, 10, func() error {
+		frozen = slices.Clone(e.Commands)
+		return fmt.Errorf("snapshot failed")
+	})
+	if err == nil {
+		t.Errorf("expected error from fn")
+	}
+	// The guests are frozen and thawed concurrently, only the phases are ordered
+	slices.Sort(frozen)
+	expected := []string{"qm guest cmd 100 fsfreeze-freeze", "qm guest cmd 101 fsfreeze-freeze"}
+	if !reflect.DeepEqual(frozen, expected) {
+		t.Errorf("commands before fn = %v, want %v", frozen, expected)
+	}
+	thawed := slices.Clone(e.Commands[len(frozen):])
+	slices.Sort(thawed)
+	expected = []string{"qm guest cmd 100 fsfreeze-thaw", "qm guest cmd 101 fsfreeze-thaw"}
+	if !reflect.DeepEqual(thawed, expected) {
+		t.Errorf("commands after fn = %v, want %v", thawed, expected)
+	}
+}
+
+// Blocks every freeze until all guests are freezing
+type barrierExec struct {
+	wg sync.WaitGroup
+}
+
+func (b *barrierExec) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	if strings.HasSuffix(cmd.String(), "fsfreeze-freeze") {
+		b.wg.Done()
+		b.wg.Wait()
+	}
+	return Result{}, nil
+}
+
+func TestWithFrozenConcurrent(t *testing.T) {
+	e := &barrierExec{}
+	vmids := []int{100, 101, 102}
+	e.wg.Add(len(vmids))
+	done := make(chan error)
+	go func() { done <- withFrozen(context.Background(), e, vmids, 10, func() error { return nil }) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("withFrozen returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the guests were frozen one after another")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Limits for the number of snapshots destroyed in one run.
+// They protect from typos like h0 instead of h48.
+type destroyGuard struct {
+	maxCount   int  // per pool, 0 - no limit
+	maxPercent int  // per dataset, 0 - no limit
+	force      bool // ignore the limits
+}
+
+// Remember the number of existing snapshots of a dataset
+func (p *Pending) countExisting(zfsName string, count int) {
+	if p.Existing == nil {
+		p.Existing = make(map[string]int)
+	}
+	p.Existing[zfsName] += count
+}
+
+// Remember that the policy of a tier destroys snapshots of a dataset
+func (p *Pending) countRotated(zfsName string) {
+	if p.Rotated == nil {
+		p.Rotated = make(map[string]int)
+	}
+	p.Rotated[zfsName]++
+}
+
+// Check pending destroys of the retention policy against the guard limits.
+// Space prunes are not counted: under space pressure they must not be refused,
+// and the watermarks and the tier minimums already bound them.
+func (p *Pending) checkDestroys() error {
+	spacePrunes := make(map[string]bool)
+	for _, name := range p.SpacePrunes {
+		spacePrunes[name] = true
+	}
+	var destroys []string
+	for _, name := range p.Destroys {
+		if !spacePrunes[name] {
+			destroys = append(destroys, name)
+		}
+	}
+	if p.Guard.force || len(destroys) == 0 {
+		return nil
+	}
+	var reasons []string
+	if p.Guard.maxCount > 0 && len(destroys) > p.Guard.maxCount {
+		reasons = append(reasons, fmt.Sprintf("%d snapshots on pool %s exceed the limit of %d",
+			len(destroys), p.Pool, p.Guard.maxCount))
+	}
+	if p.Guard.maxPercent > 0 {
+		perDataset := make(map[string]int)
+		for _, name := range destroys {
+			dataset, _, _ := strings.Cut(name, "@")
+			perDataset[dataset]++
+		}
+		var datasets []string
+		for dataset := range perDataset {
+			datasets = append(datasets, dataset)
+		}
+		sort.Strings(datasets)
+		for _, dataset := range datasets {
+			count, existing := perDataset[dataset], p.Existing[dataset]
+			// A single snapshot per rotated tier is a normal rotation step even on a small dataset,
+			// e.g. d1 m1 y1 destroys all 3 existing snapshots
+			if count > max(1, p.Rotated[dataset]) && count*100 > existing*p.Guard.maxPercent {
+				reasons = append(reasons, fmt.Sprintf("%d of %d snapshots of %s exceed the limit of %d%%",
+					count, existing, dataset, p.Guard.maxPercent))
+			}
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errDestroyRefused, strings.Join(reasons, "; "))
+}
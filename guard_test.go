@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckDestroys(t *testing.T) {
+	existing := map[string]int{"rpool/vm-100-disk-0": 10, "rpool/vm-101-disk-0": 2, "rpool/vm-102-disk-0": 3}
+	tests := []struct {
+		name     string
+		guard    destroyGuard
+		destroys []string
+		rotated  map[string]int
+		wantErr  bool
+	}{
+		{
+			name:     "normal rotation",
+			guard:    destroyGuard{maxPercent: 50},
+			destroys: []string{"rpool/vm-100-disk-0@a", "rpool/vm-100-disk-0@b", "rpool/vm-101-disk-0@a"},
+		},
+		{
+			name:     "too many of a dataset",
+			guard:    destroyGuard{maxPercent: 50},
+			destroys: []string{"rpool/vm-101-disk-0@a", "rpool/vm-101-disk-0@b"},
+			wantErr:  true,
+		},
+		{
+			name:     "one per rotated tier of a small policy",
+			guard:    destroyGuard{maxPercent: 50},
+			destroys: []string{"rpool/vm-102-disk-0@d", "rpool/vm-102-disk-0@m", "rpool/vm-102-disk-0@y"},
+			rotated:  map[string]int{"rpool/vm-102-disk-0": 3},
+		},
+		{
+			name:     "more than one per rotated tier",
+			guard:    destroyGuard{maxPercent: 50},
+			destroys: []string{"rpool/vm-102-disk-0@h1", "rpool/vm-102-disk-0@h2", "rpool/vm-102-disk-0@h3"},
+			rotated:  map[string]int{"rpool/vm-102-disk-0": 1},
+			wantErr:  true,
+		},
+		{
+			name:     "too many on a pool",
+			guard:    destroyGuard{maxCount: 2},
+			destroys: []string{"rpool/vm-100-disk-0@a", "rpool/vm-100-disk-0@b", "rpool/vm-101-disk-0@a"},
+			wantErr:  true,
+		},
+		{
+			name:     "forced",
+			guard:    destroyGuard{maxCount: 2, maxPercent: 50, force: true},
+			destroys: []string{"rpool/vm-100-disk-0@a", "rpool/vm-100-disk-0@b", "rpool/vm-101-disk-0@a", "rpool/vm-101-disk-0@b"},
+		},
+	}
+	for _, tt := range tests {
+		pending := Pending{Pool: "rpool", Guard: tt.guard, Existing: existing, Rotated: tt.rotated, Destroys: tt.destroys}
+		err := pending.checkDestroys()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkDestroys() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGetEnvironmentOptions(t *testing.T) {
+	env, err := getEnvironment([]string{"pve-zfs-snap", "h48", "--max-destroy=100", "--force-prune"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := destroyGuard{maxCount: 100, maxPercent: 50, force: true}
+	if env.guard != expected {
+		t.Errorf("guard = %+v, want %+v", env.guard, expected)
+	}
+	if _, err := getEnvironment([]string{"pve-zfs-snap", "--max-destroy=x"}); err == nil {
+		t.Errorf("expected error for invalid option value")
+	}
+}
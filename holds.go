@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	keepTag = "pve-zfs-snap-keep" // newest snapshot of every tier
+	pinTag  = "pve-zfs-snap-pin"  // snapshots pinned by an operator
+)
+
+// Hold the newest snapshot of a tier and release the keep hold from the others
+func keepNewest(pending *Pending, snapshots []snapshot, newest string) {
+	for _, snapshot := range snapshots {
+		if snapshot.name == newest {
+			if snapshot.hasHold(keepTag) {
+				newest = ""
+			}
+			continue
+		}
+		if snapshot.hasHold(keepTag) {
+			pending.Releases = append(pending.Releases, snapshot.name)
+		}
+	}
+	if newest != "" {
+		pending.Holds = append(pending.Holds, newest)
+	}
+}
+
+// Check if a snapshot has holds other than the keep hold: pins, clones or holds of other tools
+func (s snapshot) heldByOthers() bool {
+	// Holds which were not listed are foreign
+	if s.userrefs > int64(len(s.holds)) {
+		return true
+	}
+	for _, hold := range s.holds {
+		if hold != keepTag {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the snapshots the retention policy rotates: all but those held by others
+func rotatingSnapshots(snapshots []snapshot) []snapshot {
+	var rotating []snapshot
+	for _, snapshot := range snapshots {
+		if !snapshot.heldByOthers() {
+			rotating = append(rotating, snapshot)
+		}
+	}
+	return rotating
+}
+
+// Release the keep hold from all snapshots of a tier
+func releaseAll(pending *Pending, snapshots []snapshot) {
+	keepNewest(pending, snapshots, "")
+}
+
+func checkSnapshotNames(names []string) error {
+	if len(names) == 0 {
+		return &UsageError{fmt.Errorf("at least one snapshot is required")}
+	}
+	for _, name := range names {
+		if !strings.Contains(name, "@") {
+			return &UsageError{fmt.Errorf("'%s' is not a snapshot name", name)}
+		}
+	}
+	return nil
+}
+
+// Pin snapshots so that they are never pruned
+func pinSnapshots(ctx context.Context, e Exec, names []string) error {
+	if err := checkSnapshotNames(names); err != nil {
+		return err
+	}
+	_, err := command(ctx, e, "zfs", append([]string{"hold", pinTag}, names...)...)
+	return err
+}
+
+// Unpin snapshots so that the retention policy applies to them again
+func unpinSnapshots(ctx context.Context, e Exec, names []string) error {
+	if err := checkSnapshotNames(names); err != nil {
+		return err
+	}
+	_, err := command(ctx, e, "zfs", append([]string{"release", pinTag}, names...)...)
+	return err
+}
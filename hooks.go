@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command run before or after the snapshots of matching guests
+type hook struct {
+	selector string // VMID or guest tag
+	command  string // {vmid} is replaced with the VMID of the guest
+}
+
+type hookPolicy struct {
+	pre     []hook
+	post    []hook
+	timeout int  // seconds
+	abort   bool // abort the run if a pre hook fails, otherwise skip the guest
+}
+
+func parseHookOption(arg string, value string, target *[]hook) error {
+	selector, command, ok := strings.Cut(value, ":")
+	if !ok || selector == "" || command == "" {
+		return fmt.Errorf("option '%s' must have the format '<vmid|tag>:<command>'", arg)
+	}
+	*target = append(*target, hook{selector: selector, command: command})
+	return nil
+}
+
+func (h hook) matches(vm VM) bool {
+	if vmid, err := strconv.Atoi(h.selector); err == nil {
+		return vmid == vm.VMID
+	}
+	return vm.hasTag(h.selector)
+}
+
+// Get running guests which have pending snapshots and hooks
+func hookedGuests(vms []VM, pendings []*Pending, policy hookPolicy) []VM {
+	snapshotted := make(map[int]bool)
+	for _, pending := range pendings {
+		for _, name := range pending.Snapshots {
+			snapshotted[vmidOf(name)] = true
+		}
+	}
+	var guests []VM
+	for _, vm := range vms {
+		if vm.Status != "running" || !snapshotted[vm.VMID] {
+			continue
+		}
+		for _, h := range append(policy.pre, policy.post...) {
+			if h.matches(vm) {
+				guests = append(guests, vm)
+				break
+			}
+		}
+	}
+	return guests
+}
+
+// Run the hooks matching a guest and log their output.
+// On timeout OSExec kills the process group of the hook, so background children do not keep it waiting.
+func runHooks(ctx context.Context, e Exec, vm VM, hooks []hook, timeout int, stage string) error {
+	for _, h := range hooks {
+		if !h.matches(vm) {
+			continue
+		}
+		commandLine := strings.ReplaceAll(h.command, "{vmid}", strconv.Itoa(vm.VMID))
+		result, err := e.Run(ctx, Cmd{
+			Name:    "bash",
+			Args:    []string{"-c", commandLine},
+			Timeout: time.Duration(timeout) * time.Second,
+		})
+		fmt.Printf("%s hook of guest %d: %s\n", stage, vm.VMID, commandLine)
+		fmt.Print(string(result.Stdout))
+		fmt.Print(string(result.Stderr))
+		if err != nil {
+			return fmt.Errorf("%s hook '%s' failed: %v", stage, commandLine, err)
+		}
+	}
+	return nil
+}
+
+// Run the pre hooks, fn and the post hooks on any path.
+// Post hooks run only for guests whose pre hooks succeeded: a guest whose pre hook failed
+// or was not reached after an abort is not prepared for the snapshot, so there is nothing to undo.
+func withHooks(ctx context.Context, e Exec, vms []VM, pendings []*Pending, policy hookPolicy, fn func() error) error {
+	var prepared []VM
+	defer func() {
+		for _, vm := range prepared {
+			if err := runHooks(ctx, e, vm, policy.post, policy.timeout, "post"); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+	for _, vm := range hookedGuests(vms, pendings, policy) {
+		err := runHooks(ctx, e, vm, policy.pre, policy.timeout, "pre")
+		if err == nil {
+			prepared = append(prepared, vm)
+			continue
+		}
+		if policy.abort {
+			return fmt.Errorf("guest %d: %v", vm.VMID, err)
+		}
+		fmt.Printf("skipping snapshots of guest %d: %v\n", vm.VMID, err)
+		for _, pending := range pendings {
+			pending.skipGuest(vm.VMID)
+		}
+	}
+	return fn()
+}
+
+// Print the hooks and the freezing a run would do, --dry-run must not touch the guests
+func printGuestPlan(vms []VM, pendings []*Pending, hooks hookPolicy, freeze freezePolicy) {
+	for _, vm := range hookedGuests(vms, pendings, hooks) {
+		for _, stage := range []struct {
+			name  string
+			hooks []hook
+		}{{"pre", hooks.pre}, {"post", hooks.post}} {
+			for _, h := range stage.hooks {
+				if h.matches(vm) {
+					fmt.Printf("would run %s hook of guest %d: %s\n", stage.name, vm.VMID, strings.ReplaceAll(h.command, "{vmid}", strconv.Itoa(vm.VMID)))
+				}
+			}
+		}
+	}
+	for _, vmid := range freezeVMIDs(vms, pendings, freeze) {
+		fmt.Printf("would freeze VM %d\n", vmid)
+	}
+}
+
+// Drop pending snapshots of a guest together with the pruning of its datasets,
+// pruning counts on the new snapshots and is deferred to the next run
+func (p *Pending) skipGuest(vmid int) {
+	keep := func(names []string) []string {
+		var kept []string
+		for _, name := range names {
+			if vmidOf(name) != vmid {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+	p.Snapshots = keep(p.Snapshots)
+	p.Holds = keep(p.Holds)
+	p.Releases = keep(p.Releases)
+	p.Destroys = keep(p.Destroys)
+	p.SpacePrunes = keep(p.SpacePrunes)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithHooksSkipsFailedGuest(t *testing.T) {
+	vms := []VM{
+		{VMID: 100, Type: "lxc", Status: "running", Tags: "db"},
+		{VMID: 101, Type: "lxc", Status: "running", Tags: "db"},
+	}
+	pending := &Pending{
+		Snapshots: []string{"rpool/subvol-100-disk-0@new", "rpool/subvol-101-disk-0@new"},
+		Holds:     []string{"rpool/subvol-100-disk-0@new", "rpool/subvol-101-disk-0@new"},
+		Destroys:  []string{"rpool/subvol-100-disk-0@old", "rpool/subvol-101-disk-0@old"},
+	}
+	policy := hookPolicy{
+		pre:     []hook{{selector: "db", command: "pct exec {vmid} -- /pre.sh"}},
+		post:    []hook{{selector: "db", command: "pct exec {vmid} -- /post.sh"}},
+		timeout: 60,
+	}
+	e := &recordingExec{Errors: map[string]error{
+		"bash -c pct exec 100 -- /pre.sh": fmt.Errorf("exit status 1"),
+	}}
+	called := false
+	err := withHooks(context.Background(), e, vms, []*Pending{pending}, policy, func() error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Fatalf("withHooks(context.Background(), ) error = %v, called = %v", err, called)
+	}
+	expected := &Pending{
+		Snapshots: []string{"rpool/subvol-101-disk-0@new"},
+		Holds:     []string{"rpool/subvol-101-disk-0@new"},
+		Destroys:  []string{"rpool/subvol-101-disk-0@old"},
+	}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("pending = %+v, want %+v", pending, expected)
+	}
+	// The post hook runs only for the guest whose pre hook succeeded
+	expectedCommands := []string{
+		"bash -c pct exec 100 -- /pre.sh",
+		"bash -c pct exec 101 -- /pre.sh",
+		"bash -c pct exec 101 -- /post.sh",
+	}
+	if !reflect.DeepEqual(e.Commands, expectedCommands) {
+		t.Errorf("commands = %v, want %v", e.Commands, expectedCommands)
+	}
+}
+
+func TestWithHooksAbort(t *testing.T) {
+	vms := []VM{{VMID: 100, Type: "lxc", Status: "running"}, {VMID: 101, Type: "lxc", Status: "running"}}
+	pending := &Pending{Snapshots: []string{"rpool/subvol-100-disk-0@new", "rpool/subvol-101-disk-0@new"}}
+	policy := hookPolicy{
+		pre:     []hook{{selector: "100", command: "false"}, {selector: "101", command: "true"}},
+		post:    []hook{{selector: "100", command: "echo 100"}, {selector: "101", command: "echo 101"}},
+		timeout: 5,
+		abort:   true,
+	}
+	e := &recordingExec{Errors: map[string]error{
+		"bash -c false": fmt.Errorf("exit status 1"),
+	}}
+	err := withHooks(context.Background(), e, vms, []*Pending{pending}, policy, func() error {
+		t.Errorf("fn must not be called")
+		return nil
+	})
+	if err == nil {
+		t.Errorf("expected error")
+	}
+	// Guest 101 is never reached, so no post hook runs
+	if expected := []string{"bash -c false"}; !reflect.DeepEqual(e.Commands, expected) {
+		t.Errorf("commands = %v, want %v", e.Commands, expected)
+	}
+}
+
+func TestRunDryRunSkipsHooksAndFreeze(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	mockExec.Stdin = make(map[string][]byte)
+	env := runTestEnv(t, "h2", "--dry-run", "--freeze=all", "--pre-hook=100:/pre.sh", "--post-hook=100:/post.sh")
+	if _, err := Run(context.Background(), env, deps{exec: mockExec, source: PveshSource{Exec: mockExec}}); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	for key := range mockExec.Stdin {
+		if strings.HasPrefix(key, "bash") || strings.HasPrefix(key, "qm") {
+			t.Errorf("dry run executed %s", key)
+		}
+	}
+}
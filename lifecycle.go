@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+)
+
+// PVE locks of operations which change the disks of a guest or move it to another node.
+// A snapshot in the middle of such an operation is useless, and during a migration
+// the guest disappears from the node, so the run would label its disks as stopped.
+var deferringLocks = map[string]bool{
+	"backup":          true,
+	"clone":           true,
+	"create":          true,
+	"migrate":         true,
+	"rollback":        true,
+	"snapshot":        true,
+	"snapshot-delete": true,
+}
+
+// VMIDs of the guests of the node by how a run treats them
+type runGuests struct {
+	all       []int          // guests without templates and deferred guests
+	running   []int          // running guests of all
+	templates []int          // templates, they follow the template policy
+	deferred  map[int]string // locks of the guests deferred to the next run
+}
+
+// Parse the snapshot policy of templates: '<one_letter><int>' items like the parameters, or 'none'
+func parseTemplatePolicy(arg string, value string, target *map[string]policy) error {
+	if value == "none" {
+		*target = nil
+		return nil
+	}
+	counts := make(map[string]int)
+	if err := parseTierCounts(arg, value, counts); err != nil {
+		return err
+	}
+	*target = make(map[string]policy)
+	for tier, count := range counts {
+		(*target)[tier] = policy{count: count, interval: tierIntervals[tier]}
+	}
+	return nil
+}
+
+// Get the lock of a guest: /cluster/resources reports it, the config is the fallback
+func lockOf(vm VM, configs guestConfigs) string {
+	if vm.Lock != "" {
+		return vm.Lock
+	}
+	if config := configs[vm.VMID]; config != nil {
+		return config.lock
+	}
+	return ""
+}
+
+// Sort the guests of the node for a run
+func newRunGuests(vms []VM, configs guestConfigs) runGuests {
+	guests := runGuests{deferred: make(map[int]string)}
+	for _, vm := range vms {
+		if lock := lockOf(vm, configs); deferringLocks[lock] {
+			guests.deferred[vm.VMID] = lock
+			continue
+		}
+		if vm.Template == 1 {
+			guests.templates = append(guests.templates, vm.VMID)
+			continue
+		}
+		guests.all = append(guests.all, vm.VMID)
+		if vm.Status == "running" {
+			guests.running = append(guests.running, vm.VMID)
+		}
+	}
+	return guests
+}
+
+// Drop the deferred guests, so that hooks and freezing skip them
+func (g runGuests) active(vms []VM) []VM {
+	var active []VM
+	for _, vm := range vms {
+		if lock, ok := g.deferred[vm.VMID]; ok {
+			fmt.Printf("guest %d is locked (%s), deferred to the next run\n", vm.VMID, lock)
+			continue
+		}
+		active = append(active, vm)
+	}
+	return active
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewRunGuests(t *testing.T) {
+	vms := []VM{
+		{VMID: 100, Status: "running"},
+		{VMID: 101, Status: "stopped"},
+		{VMID: 102, Status: "running", Lock: "backup"},
+		{VMID: 103, Status: "running"},
+		{VMID: 104, Status: "stopped", Template: 1},
+		{VMID: 105, Status: "stopped", Lock: "suspended"},
+		{VMID: 106, Status: "running"},
+	}
+	configs := guestConfigs{
+		103: {lock: "migrate"},
+		106: nil,
+	}
+	expected := runGuests{
+		all:       []int{100, 101, 105, 106},
+		running:   []int{100, 106},
+		templates: []int{104},
+		deferred:  map[int]string{102: "backup", 103: "migrate"},
+	}
+	if guests := newRunGuests(vms, configs); !reflect.DeepEqual(guests, expected) {
+		t.Errorf("newRunGuests() = %+v, want %+v", guests, expected)
+	}
+}
+
+func TestParseTemplatePolicy(t *testing.T) {
+	env, err := getEnvironment([]string{"pve-zfs-snap", "h24", "--template-policy=d1,m3"})
+	if err != nil {
+		t.Fatalf("getEnvironment returned error: %v", err)
+	}
+	expected := map[string]policy{
+		daily:   {count: 1, interval: 3600 * 24},
+		monthly: {count: 3, interval: 3600 * 24 * 30},
+	}
+	if !reflect.DeepEqual(env.templatePolicy, expected) {
+		t.Errorf("templatePolicy = %v, want %v", env.templatePolicy, expected)
+	}
+
+	env, err = getEnvironment([]string{"pve-zfs-snap", "h24", "--template-policy=d1", "--template-policy=none"})
+	if err != nil || env.templatePolicy != nil {
+		t.Errorf("templatePolicy = %v, %v, want nil", env.templatePolicy, err)
+	}
+	if _, err := getEnvironment([]string{"pve-zfs-snap", "h24", "--template-policy=x1"}); err == nil {
+		t.Errorf("getEnvironment accepted --template-policy=x1")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type listOptions struct {
+	vmid   int    // 0 - all guests
+	pool   string // "" - all pools
+	tier   string // "" - all tiers
+	output string
+}
+
+// Snapshot of a guest disk shown by the list subcommand
+type listRow struct {
+	VMID       int      `json:"vmid"`
+	Guest      string   `json:"guest"`
+	Disk       string   `json:"disk"`
+	Tier       string   `json:"tier"`
+	Snapshot   string   `json:"snapshot"`
+	Creation   int64    `json:"creation"`
+	Age        int64    `json:"age"` // seconds
+	Used       int64    `json:"used"`
+	Referenced int64    `json:"referenced"`
+	Holds      []string `json:"holds"`
+}
+
+func (o *listOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--vmid' requires a VMID")
+		}
+		o.vmid = vmid
+	case "pool":
+		o.pool = value
+	case "tier":
+		if !slices.Contains(tiers, value) {
+			return true, fmt.Errorf("option '--tier' must be one of %s", strings.Join(tiers, ", "))
+		}
+		o.tier = value
+	case "output":
+		if value != "table" && value != "json" && value != "csv" {
+			return true, fmt.Errorf("option '--output' must be table, json or csv")
+		}
+		o.output = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Show snapshots of the guests of the node
+func listCommand(ctx context.Context, e Exec, args []string) error {
+	options := listOptions{output: "table"}
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	rows, err := listSnapshots(ctx, e, source, env, options)
+	if err != nil {
+		return err
+	}
+	return writeList(os.Stdout, rows, options.output)
+}
+
+// Get snapshots of guest disks grouped by guest, disk and tier
+func listSnapshots(ctx context.Context, e Exec, source VMSource, env environment, options listOptions) ([]listRow, error) {
+	vms, err := ListVMs(ctx, source, env.hostname)
+	if err != nil {
+		return nil, err
+	}
+	guests := make(map[int]string)
+	var vmIDs []int
+	for _, vm := range vms {
+		if options.vmid == 0 || vm.VMID == options.vmid {
+			guests[vm.VMID] = vm.Name
+			vmIDs = append(vmIDs, vm.VMID)
+		}
+	}
+	if len(vmIDs) == 0 {
+		return []listRow{}, nil
+	}
+
+	pools := []string{options.pool}
+	if options.pool == "" {
+		pools, err = ZpoolList(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+		var missing []string
+		pools, missing = env.filter.filterPools(pools)
+		if options.output == "table" {
+			logMissingPools(missing)
+		}
+	}
+
+	rows := []listRow{}
+	for _, pool := range pools {
+		allZFS, err := ZFSlist(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		poolSnapshots, err := ZfsListPoolSnapshots(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		naming := env.namingOf(pool)
+		for _, zfs := range filterZfsInVms(env.filter.filterDatasets(allZFS), vmIDs) {
+			vmid := vmidOf(zfs.name)
+			groupedSnapshots := splitSnapshots(poolSnapshots[zfs.name], naming)
+			for _, tier := range tiers {
+				if options.tier != "" && tier != options.tier {
+					continue
+				}
+				for _, snapshot := range groupedSnapshots[tier] {
+					_, name, _ := strings.Cut(snapshot.name, "@")
+					rows = append(rows, listRow{
+						VMID:       vmid,
+						Guest:      guests[vmid],
+						Disk:       zfs.name,
+						Tier:       tier,
+						Snapshot:   name,
+						Creation:   snapshot.creation,
+						Age:        env.time.unix - snapshot.creation,
+						Used:       snapshot.used,
+						Referenced: snapshot.referenced,
+						Holds:      nonNil(snapshot.holds),
+					})
+				}
+			}
+		}
+	}
+	// Disks of a guest may be on several pools
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].VMID != rows[j].VMID {
+			return rows[i].VMID < rows[j].VMID
+		}
+		return rows[i].Disk < rows[j].Disk
+	})
+	return rows, nil
+}
+
+func writeList(w io.Writer, rows []listRow, output string) error {
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"vmid", "guest", "disk", "tier", "snapshot", "creation", "age", "used", "referenced", "holds"})
+		for _, row := range rows {
+			writer.Write([]string{
+				strconv.Itoa(row.VMID), row.Guest, row.Disk, row.Tier, row.Snapshot,
+				strconv.FormatInt(row.Creation, 10), strconv.FormatInt(row.Age, 10),
+				strconv.FormatInt(row.Used, 10), strconv.FormatInt(row.Referenced, 10),
+				strings.Join(row.Holds, " "),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "VMID\tGUEST\tDISK\tTIER\tSNAPSHOT\tAGE\tUSED\tREFER\tHOLDS")
+	for _, row := range rows {
+		holds := strings.Join(row.Holds, ",")
+		if holds == "" {
+			holds = "-"
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.VMID, row.Guest, row.Disk, row.Tier, row.Snapshot,
+			formatAge(row.Age), formatBytes(row.Used), formatBytes(row.Referenced), holds)
+	}
+	return writer.Flush()
+}
+
+// Format seconds as the two largest units, e.g. 3d4h
+func formatAge(seconds int64) string {
+	days, hours, minutes := seconds/86400, seconds%86400/3600, seconds%3600/60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%ds", max(seconds, 0))
+}
+
+// Format bytes with a binary unit like zfs list, e.g. 1.5G
+func formatBytes(bytes int64) string {
+	const units = "KMGTPE"
+	if bytes < 1024 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes)
+	i := -1
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f%c", value, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", value, units[i])
+}
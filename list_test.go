@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestListSnapshots(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	env := runTestEnv(t)
+	rows, err := listSnapshots(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, listOptions{vmid: 100, tier: hourly})
+	if err != nil {
+		t.Fatalf("listSnapshots returned error: %v", err)
+	}
+	expected := []listRow{
+		{VMID: 100, Guest: "web", Disk: "rpool/data/vm-100-disk-0", Tier: hourly, Snapshot: "autosnap_2023-01-24_06:00:02_hourly", Creation: 1674540002, Age: 7200, Holds: []string{}},
+		{VMID: 100, Guest: "web", Disk: "rpool/data/vm-100-disk-0", Tier: hourly, Snapshot: "autosnap_2023-01-24_07:00:02_hourly", Creation: 1674543602, Age: 3600, Holds: []string{}},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("listSnapshots() = %+v, want %+v", rows, expected)
+	}
+
+	rows, err = listSnapshots(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, listOptions{vmid: 999})
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected no snapshots of an unknown guest, got %v, %v", rows, err)
+	}
+
+	// Pools and datasets excluded from runs are not listed
+	mockExec = newRunTestExec("rpool", "backup")
+	env = runTestEnv(t, "--exclude-pool=backup")
+	rows, err = listSnapshots(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, listOptions{vmid: 100, tier: hourly, output: "json"})
+	if err != nil || !reflect.DeepEqual(rows, expected) {
+		t.Errorf("listSnapshots() with filters = %+v, %v, want %+v", rows, err, expected)
+	}
+	env = runTestEnv(t, "--exclude-dataset=rpool/data")
+	rows, err = listSnapshots(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, listOptions{vmid: 100, tier: hourly, output: "json"})
+	if err != nil || len(rows) != 2 || rows[0].Disk != "backup/data/vm-100-disk-0" {
+		t.Errorf("expected only the snapshots on backup, got %+v, %v", rows, err)
+	}
+}
+
+func TestWriteList(t *testing.T) {
+	rows := []listRow{
+		{VMID: 100, Guest: "web", Disk: "rpool/data/vm-100-disk-0", Tier: daily, Snapshot: "autosnap_2023-01-24_00:00:02_daily",
+			Creation: 1674518402, Age: 93784, Used: 1536, Referenced: 10 << 30, Holds: []string{keepTag}},
+	}
+	var table bytes.Buffer
+	if err := writeList(&table, rows, "table"); err != nil {
+		t.Fatal(err)
+	}
+	expectedTable := "VMID  GUEST  DISK                      TIER   SNAPSHOT                            AGE   USED  REFER  HOLDS\n" +
+		"100   web    rpool/data/vm-100-disk-0  daily  autosnap_2023-01-24_00:00:02_daily  1d2h  1.5K  10G    pve-zfs-snap-keep\n"
+	if table.String() != expectedTable {
+		t.Errorf("unexpected table:\n%s\nwant:\n%s", table.String(), expectedTable)
+	}
+
+	var csv bytes.Buffer
+	if err := writeList(&csv, rows, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	expectedCSV := "vmid,guest,disk,tier,snapshot,creation,age,used,referenced,holds\n" +
+		"100,web,rpool/data/vm-100-disk-0,daily,autosnap_2023-01-24_00:00:02_daily,1674518402,93784,1536,10737418240,pve-zfs-snap-keep\n"
+	if csv.String() != expectedCSV {
+		t.Errorf("unexpected csv:\n%s\nwant:\n%s", csv.String(), expectedCSV)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	options := listOptions{output: "table"}
+	env, err := subcommandEnvironment([]string{"pve-zfs-snap", "list", "--vmid=100", "--tier=daily", "--output=json", "--node=HOST-1"}, options.setOption)
+	if err != nil {
+		t.Fatalf("subcommandEnvironment returned error: %v", err)
+	}
+	if !reflect.DeepEqual(options, listOptions{vmid: 100, tier: daily, output: "json"}) || env.hostname != "HOST-1" {
+		t.Errorf("unexpected options %+v, hostname %s", options, env.hostname)
+	}
+	for _, arg := range []string{"--vmid=x", "--tier=weekly", "--output=xml", "--unknown"} {
+		if _, err := subcommandEnvironment([]string{"pve-zfs-snap", "list", arg}, options.setOption); exitCode(err) != exitUsage {
+			t.Errorf("expected usage error for %s, got %v", arg, err)
+		}
+	}
+}
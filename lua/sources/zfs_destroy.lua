@@ -1,6 +1,7 @@
 -- Initialization of tables to store information
 succeeded = {}
 failed = {}
+held = {}
 
 -- Retrieve the arguments
 args = ...
@@ -8,11 +9,17 @@ argv = args["argv"]
 
 for i=1, #argv do
     snap_name = argv[i]
-    local err = zfs.sync.destroy(snap_name)
-    if (err ~= 0) then
-        failed[snap_name] = err
+    -- Held snapshots can not be destroyed, report them separately
+    local ok, userrefs = pcall(zfs.get_prop, snap_name, "userrefs")
+    if (ok and userrefs ~= nil and userrefs > 0) then
+        held[snap_name] = userrefs
     else
-        succeeded[snap_name] = err
+        local err = zfs.sync.destroy(snap_name)
+        if (err ~= 0) then
+            failed[snap_name] = err
+        else
+            succeeded[snap_name] = err
+        end
     end
 end
 
@@ -20,4 +27,5 @@ end
 results = {}
 results["succeeded"] = succeeded
 results["failed"] = failed
+results["held"] = held
 return results
\ No newline at end of file
@@ -5,6 +5,7 @@ func lua_destroy() string {
 	return `-- Initialization of tables to store information about the created snapshots and any errors that occurred
     succeeded = {}
     failed = {}
+    held = {}
     
     -- Retrieve the arguments
     args = ...
@@ -13,11 +14,17 @@ func lua_destroy() string {
     -- Create a snapshot for each provided filesystem
     for i=1, #argv do
         snap_name = argv[i]
-        local err = zfs.sync.destroy(snap_name)
-        if (err ~= 0) then
-            failed[snap_name] = err
+        -- Held snapshots can not be destroyed, report them separately
+        local ok, userrefs = pcall(zfs.get_prop, snap_name, "userrefs")
+        if (ok and userrefs ~= nil and userrefs > 0) then
+            held[snap_name] = userrefs
         else
-            succeeded[snap_name] = err
+            local err = zfs.sync.destroy(snap_name)
+            if (err ~= 0) then
+                failed[snap_name] = err
+            else
+                succeeded[snap_name] = err
+            end
         end
     end
     
@@ -25,6 +32,7 @@ func lua_destroy() string {
     results = {}
     results["succeeded"] = succeeded
     results["failed"] = failed
+    results["held"] = held
     return results    
 `
 }
@@ -0,0 +1,68 @@
+package main
+
+// return lua code for rollback
+func lua_rollback() string {
+	return `-- Initialization of tables to store information
+    succeeded = {}
+    failed = {}
+    
+    -- Retrieve the arguments
+    args = ...
+    argv = args["argv"]
+    
+    -- First argument is the snapshot name without the dataset
+    snap = argv[1]
+    
+    -- Check all datasets first, nothing is changed if any of them can not be rolled back
+    newer = {}
+    for i=2, #argv do
+        zfs_name = argv[i]
+        target = zfs_name .. "@" .. snap
+        if (not zfs.exists(target)) then
+            failed[target] = 2
+        else
+            txg = zfs.get_prop(target, "createtxg")
+            newer[zfs_name] = {}
+            for snap_name in zfs.list.snapshots(zfs_name) do
+                if (zfs.get_prop(snap_name, "createtxg") > txg) then
+                    local err = zfs.check.destroy(snap_name)
+                    if (err ~= 0) then
+                        failed[snap_name] = err
+                    end
+                    table.insert(newer[zfs_name], snap_name)
+                end
+            end
+        end
+    end
+    
+    -- Rollback can only go to the newest snapshot, so the newer snapshots are destroyed first.
+    -- The first failure stops the program: the dataset is not rolled back and the next datasets are not changed
+    if (next(failed) == nil) then
+        for i=2, #argv do
+            zfs_name = argv[i]
+            for _, snap_name in ipairs(newer[zfs_name]) do
+                local err = zfs.sync.destroy(snap_name)
+                if (err ~= 0) then
+                    failed[snap_name] = err
+                    break
+                end
+            end
+            if (next(failed) ~= nil) then
+                break
+            end
+            local err = zfs.sync.rollback(zfs_name)
+            if (err ~= 0) then
+                failed[zfs_name] = err
+                break
+            end
+            succeeded[zfs_name] = err
+        end
+    end
+    
+    -- Return the results
+    results = {}
+    results["succeeded"] = succeeded
+    results["failed"] = failed
+    return results
+`
+}
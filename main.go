@@ -3,10 +3,12 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,19 +23,61 @@ const (
 	stopped    = "stopped" // for stopped VMs
 )
 
+// Retention tiers in the order they are processed
+var tiers = []string{yearly, monthly, daily, hourly, frequently, stopped}
+
 type policy struct {
 	count    int
 	interval int64
+	// Skip the snapshot if the dataset has written no more than skipWritten bytes
+	// since its latest snapshot
+	skipUnchanged bool
+	skipWritten   int64
 }
 
 type environment struct {
 	hostname string
 	path     string
 	time     struct {
-		unix  int64
-		human string
+		now  time.Time
+		unix int64
 	}
 	policy map[string]policy
+	guard  destroyGuard
+	space  spacePolicy
+	dryRun bool
+	// Thresholds of the written property per tier, see policy.skipWritten
+	skipUnchanged map[string]int
+	freeze        freezePolicy
+	hooks         hookPolicy
+	api           apiConfig
+	naming        map[string][]string // scheme names by pool, "" for all pools
+	format        snapshotFormat
+	node          string // PVE node name, the hostname by default
+	parallel      int    // number of pools processed at once
+	poolTimeout   int    // seconds, 0 - no limit
+	report        reportPolicy
+	filter        datasetFilter
+	// Policy of templates by tier, nil - templates are not snapshotted
+	templatePolicy map[string]policy
+}
+
+// Tiers by the keys of the parameters
+var tierByKey = map[string]string{
+	"f": frequently,
+	"h": hourly,
+	"d": daily,
+	"m": monthly,
+	"y": yearly,
+}
+
+// Seconds between snapshots of a tier
+var tierIntervals = map[string]int64{
+	frequently: 0,
+	hourly:     3600,
+	daily:      3600 * 24,
+	monthly:    3600 * 24 * 30,
+	yearly:     3600 * 24 * 365,
 }
 
 func help() {
@@ -45,79 +89,242 @@ func help() {
 	fmt.Println("  d<int> - number of daily snapshots")
 	fmt.Println("  m<int> - number of monthly snapshots")
 	fmt.Println("  y<int> - number of yearly snapshots")
+	fmt.Println("Options:")
+	fmt.Println("  --max-destroy=<int>         - refuse to destroy more snapshots per pool (0 - no limit)")
+	fmt.Println("  --max-destroy-percent=<int> - refuse to destroy more percent of snapshots of a dataset (default 50)")
+	fmt.Println("  --force-prune               - destroy snapshots even if the limits are exceeded")
+	fmt.Println("  --space-high=<int>          - prune snapshots when the pool capacity reaches this percent")
+	fmt.Println("  --space-low=<int>           - prune snapshots down to this percent (default high-10)")
+	fmt.Println("  --space-min=<key><int>,...  - snapshots per tier never pruned for space, e.g. h12,d7")
+	fmt.Println("  --dry-run                   - print the plan without changing anything")
+	fmt.Println("  --skip-unchanged=<key><int> - skip f/h snapshots if no more bytes were written, e.g. f0,h4096")
+	fmt.Println("  --freeze=<vmid>,...         - freeze guest filesystems during snapshots, 'all' for every VM")
+	fmt.Println("  --freeze-timeout=<int>      - seconds to wait for the guest agent (default 10)")
+	fmt.Println("  --pre-hook=<vmid|tag>:<cmd> - run a command before the snapshots of a guest, {vmid} is replaced")
+	fmt.Println("  --post-hook=<vmid|tag>:<cmd> - run a command after the snapshots of a guest")
+	fmt.Println("  --hook-timeout=<int>        - seconds a hook may run (default 60)")
+	fmt.Println("  --hook-failure=skip|abort   - skip the guest or abort the run if a pre hook fails (default skip)")
+	fmt.Println("  --node=<name>               - PVE node name (default hostname)")
+	fmt.Println("  --api-url=<url>             - use the REST API instead of pvesh, e.g. https://pve1:8006")
+	fmt.Println("  --api-token-file=<path>     - file with the API token USER@REALM!TOKENID=SECRET")
+	fmt.Println("  --api-ca=<path>             - trust only this CA for the API")
+	fmt.Println("  --api-fingerprint=<sha256>  - pin the SHA-256 fingerprint of the API certificate")
+	fmt.Println("  --naming=[<pool>:]<scheme>[+<scheme>...] - snapshot naming: autosnap, sanoid, zfs-auto-snapshot;")
+	fmt.Println("                                the first names new snapshots, the others are adopted")
+	fmt.Println("  --prefix=<string>           - prefix of snapshot names (default autosnap); snapshots of the old")
+	fmt.Println("                                prefix or time format are pruned only with --naming=autosnap+sanoid")
+	fmt.Println("  --time-format=<layout>      - Go time layout of snapshot names (default 2006-01-02_15:04:05)")
+	fmt.Println("  --time-zone=<zone>          - time zone of snapshot names, e.g. Local (default UTC)")
+	fmt.Println("  --parallel=<int>            - number of pools processed at once (default 4)")
+	fmt.Println("  --pool-timeout=<int>        - seconds every step of a pool may take, 0 - no limit (default 600)")
+	fmt.Println("  --report-dir=<path>         - directory of JSON run reports, empty - no reports")
+	fmt.Println("                                (default /var/log/pve-zfs-snap)")
+	fmt.Println("  --report-keep=<int>         - number of run reports kept (default 100)")
+	fmt.Println("  --pool=<pool>,...           - process only these pools, the option may be repeated")
+	fmt.Println("  --exclude-pool=<pool>,...   - never process these pools, e.g. backup pools")
+	fmt.Println("  --include-dataset=<glob>,... - process only matching datasets or datasets under them")
+	fmt.Println("  --exclude-dataset=<glob>,... - never process matching datasets or datasets under them")
+	fmt.Println("                                the filters may also be set in /etc/pve-zfs-snap.conf, e.g. exclude-pool=backup")
+	fmt.Println("  --template-policy=<key><int>,...|none - snapshots of templates, e.g. m1 (default none)")
+	fmt.Println("Subcommands:")
+	fmt.Println("  pin <snapshot>...   - keep snapshots until they are unpinned")
+	fmt.Println("  unpin <snapshot>... - return snapshots to the retention policy")
+	fmt.Println("  list [--vmid=<int>] [--pool=<pool>] [--tier=<tier>] [--output=table|json|csv]")
+	fmt.Println("                      - show snapshots of guests by disk and tier")
+	fmt.Println("  status [<policy>...] [--vmid=<int>] [--output=table|json]")
+	fmt.Println("                      - show the protection state of guests: OK, STALE, UNPROTECTED,")
+	fmt.Println("                        REPLICA, DEFERRED or TEMPLATE")
+	fmt.Println("  rollback --vmid=<int> --snapshot=<name> [--safety-snapshot] [--force] [--multi-pool]")
+	fmt.Println("                      - roll back all disks of a stopped guest to a snapshot;")
+	fmt.Println("                        --safety-snapshot first copies the disks in full with zfs send/receive,")
+	fmt.Println("                        it takes as much space and time as the data of the disks")
+	fmt.Println("  clone --vmid=<int> --snapshot=<name> --new-vmid=<int>")
+	fmt.Println("                      - clone a guest from a snapshot, its network is disconnected")
+	fmt.Println("  clone --destroy-clone --new-vmid=<int>")
+	fmt.Println("                      - destroy the disks and the config of a clone")
+	fmt.Println("  restore-file --vmid=<int> --snapshot=<name> --path=<path>... [--disk=<name>] [--target=<dir>]")
+	fmt.Println("                      - copy files of a guest out of a snapshot")
+	fmt.Println("  diff --vmid=<int> --from=<name> [--to=<name>|now] [--output=table|json]")
+	fmt.Println("                      - show files of a container changed between snapshots")
+	fmt.Println("  usage [--vmid=<int>] [--output=table|json|csv]")
+	fmt.Println("                      - show change rates of guests and predicted replication volume")
 }
 
-// Regular expression to match snapshot types
-var snapshotTypeRE = regexp.MustCompile(`@autosnap_[0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}:[0-9]{2}:[0-9]{2}_([a-z]+)`)
-
 func init() {
 	os.Setenv("PATH", os.Getenv("PATH")+":/usr/local/sbin:/usr/local/bin:/sbin:/bin:/usr/sbin:/usr/bin")
 }
 
-func checkCallLuaCode(args []string) error {
+// Lua code of channel programs by name
+var luaPrograms = map[string]func() string{
+	"lua_hello":       lua_hello,
+	"lua_snapshot":    lua_snapshot,
+	"lua_destroy":     lua_destroy,
+	"lua_set_running": lua_set_running,
+	"lua_rollback":    lua_rollback,
+}
+
+// Print the code of a channel program, handled is false if the arguments do not name one
+func checkCallLuaCode(args []string) (handled bool, err error) {
+	if len(args) < 2 {
+		return false, &UsageError{fmt.Errorf("minimum number of parameters is 1")}
+	}
+
+	if code, ok := luaPrograms[args[1]]; ok {
+		fmt.Println(code())
+		return true, nil
+	}
+	return false, nil
+}
+
+// Run a subcommand, handled is false if the arguments are not a subcommand
+func runSubcommand(ctx context.Context, e Exec, args []string) (handled bool, err error) {
 	if len(args) < 2 {
-		return fmt.Errorf("minimum number of parameters is 1")
+		return false, nil
 	}
 
 	switch args[1] {
-	case "lua_hello":
-		fmt.Println(lua_hello())
-		os.Exit(0)
-	case "lua_snapshot":
-		fmt.Println(lua_snapshot())
-		os.Exit(0)
-	case "lua_destroy":
-		fmt.Println(lua_destroy())
-		os.Exit(0)
-	case "lua_set_running":
-		fmt.Println(lua_set_running())
-		os.Exit(0)
-	}
-	return nil
+	case "pin":
+		return true, pinSnapshots(ctx, e, args[2:])
+	case "unpin":
+		return true, unpinSnapshots(ctx, e, args[2:])
+	case "list":
+		return true, listCommand(ctx, e, args)
+	case "status":
+		return true, statusCommand(ctx, e, args)
+	case "rollback":
+		return true, rollbackCommand(ctx, e, args)
+	case "clone":
+		return true, cloneCommand(ctx, e, args)
+	case "restore-file":
+		return true, restoreFileCommand(ctx, e, args)
+	case "diff":
+		return true, diffCommand(ctx, e, args)
+	case "usage":
+		return true, usageCommand(ctx, e, args)
+	}
+	return false, nil
+}
+
+// Parse the parameters of a subcommand, its own options are passed to setOption,
+// the other parameters are parsed as the parameters of a run
+func subcommandEnvironment(args []string, setOption func(name string, value string) (bool, error)) (environment, error) {
+	rest := []string{args[0]}
+	for _, arg := range args[2:] {
+		name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if strings.HasPrefix(arg, "--") {
+			ok, err := setOption(name, value)
+			if err != nil {
+				return environment{}, &UsageError{err}
+			}
+			if ok {
+				continue
+			}
+		}
+		rest = append(rest, arg)
+	}
+	env, err := parseArgs(rest)
+	if err != nil {
+		return environment{}, &UsageError{err}
+	}
+	return env, nil
 }
 
 func getEnvironment(args []string) (environment, error) {
+	env, err := parseEnvironment(args)
+	if err != nil {
+		return environment{}, &UsageError{err}
+	}
+	return env, nil
+}
+
+func parseEnvironment(args []string) (environment, error) {
 	if len(args) < 2 {
 		return environment{}, fmt.Errorf("minimum number of parameters is 1")
 	}
+	return parseArgs(args)
+}
 
+// Parse the path of the program and its parameters, all parameters are optional
+func parseArgs(args []string) (environment, error) {
 	var env = environment{
 		policy: make(map[string]policy),
+		guard:  destroyGuard{maxPercent: 50},
+		space:  spacePolicy{min: make(map[string]int)},
+
+		skipUnchanged: make(map[string]int),
+		freeze:        freezePolicy{vmids: make(map[int]bool), timeout: 10},
+		hooks:         hookPolicy{timeout: 60},
+		naming:        make(map[string][]string),
+		format:        defaultSnapshotFormat,
+		parallel:      4,
+		poolTimeout:   600,
+		report:        reportPolicy{dir: "/var/log/pve-zfs-snap", keep: 100},
+	}
+	// The command line adds to the filters of the config file
+	if err := env.filter.readConfig(filterConfigFile); err != nil {
+		return environment{}, err
 	}
 
 	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "--") {
+			if err := env.setOption(arg); err != nil {
+				return environment{}, err
+			}
+			continue
+		}
 		i, err := strconv.Atoi(arg[1:])
 		if err != nil {
 			return environment{}, fmt.Errorf("parameter '%s' is not a number", arg)
 		}
-		switch arg[0] {
-		case 'f':
-			env.policy[frequently] = policy{count: i, interval: 0}
-		case 'h':
-			env.policy[hourly] = policy{count: i, interval: 3600}
-		case 'd':
-			env.policy[daily] = policy{count: i, interval: 3600 * 24}
-		case 'm':
-			env.policy[monthly] = policy{count: i, interval: 3600 * 24 * 30}
-		case 'y':
-			env.policy[yearly] = policy{count: i, interval: 3600 * 24 * 365}
-		default:
+		tier, ok := tierByKey[arg[:1]]
+		if !ok {
 			return environment{}, fmt.Errorf("unknown parameter '%s'", arg)
 		}
+		env.policy[tier] = policy{count: i, interval: tierIntervals[tier]}
+	}
+	for tier, threshold := range env.skipUnchanged {
+		// Calendar tiers must always be created
+		if tier != frequently && tier != hourly {
+			return environment{}, fmt.Errorf("--skip-unchanged is only supported for f and h")
+		}
+		p := env.policy[tier]
+		p.skipUnchanged = true
+		p.skipWritten = int64(threshold)
+		env.policy[tier] = p
+	}
+	if err := env.format.check(); err != nil {
+		return environment{}, err
+	}
+	if env.space.low == 0 {
+		env.space.low = max(env.space.high-10, 0)
+	}
+	if env.space.low > env.space.high {
+		return environment{}, fmt.Errorf("--space-low must not be greater than --space-high")
 	}
 	env.path = args[0]
-	env.time.human = time.Now().Format("2006-01-02_15:04:05")
-	env.time.unix = time.Now().Unix()
+	env.time.now = time.Now()
+	env.time.unix = env.time.now.Unix()
 	env.hostname, _ = os.Hostname()
+	if env.node != "" {
+		env.hostname = env.node
+	}
+	if env.api.url != "" && env.api.tokenFile == "" {
+		return environment{}, fmt.Errorf("--api-url requires --api-token-file")
+	}
 	return env, nil
 }
 
-func checkErr(err error) {
-	if err != nil {
-		fmt.Println(err)
+// Print the error and exit with its code, help is shown only for usage errors
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Println(err)
+	var usageErr *UsageError
+	if errors.As(err, &usageErr) {
 		help()
-		os.Exit(1)
 	}
+	os.Exit(exitCode(err))
 }
 
 // VM represents a virtual machine or container
@@ -136,22 +343,25 @@ type VM struct {
 	NetOut    int64   `json:"netout"`
 	Node      string  `json:"node"`
 	Status    string  `json:"status"`
+	Tags      string  `json:"tags"`
+	Lock      string  `json:"lock"`
 	Template  int     `json:"template"`
 	Type      string  `json:"type"`
 	Uptime    int64   `json:"uptime"`
 	VMID      int     `json:"vmid"`
 }
 
-// GetVMs retrieves the list of VMs for the current node
-func GetVMs(e Exec, node string) ([]VM, error) {
-	output, err := e.Command("pvesh", "get", "/cluster/resources", "--type", "vm", "--output-format", "json")
+// GetVMs retrieves the list of VMs for the current node with pvesh
+func GetVMs(ctx context.Context, e Exec, node string) ([]VM, error) {
+	return ListVMs(ctx, PveshSource{Exec: e}, node)
+}
+
+// ListVMs retrieves the list of VMs for the node from a VM source
+func ListVMs(ctx context.Context, source VMSource, node string) ([]VM, error) {
+	allVMs, err := source.ClusterResources(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var allVMs []VM
-	if err := json.Unmarshal(output, &allVMs); err != nil {
-		return nil, err
-	}
 	var nodeVMs []VM
 	for _, vm := range allVMs {
 		if vm.Node == node {
@@ -189,7 +399,9 @@ func filterZfsInVms(zfsList []zfs, vmIDs []int) []zfs {
 		vmidStrings[i] = strconv.Itoa(vmid)
 	}
 	vmidPattern := strings.Join(vmidStrings, "|")
-	re := regexp.MustCompile(fmt.Sprintf("vm-(%s)-disk-|subvol-(%s)-disk-", vmidPattern, vmidPattern))
+	// Disks of templates are renamed to base-<vmid>-disk-<n> and basevol-<vmid>-disk-<n>.
+	// The name must start the basename, restore clones and other datasets may contain a disk name.
+	re := regexp.MustCompile(fmt.Sprintf("(?:^|/)(?:vm|subvol|base|basevol)-(%s)-disk-", vmidPattern))
 	for _, zfs := range zfsList {
 		if re.MatchString(zfs.name) {
 			filteredZfs = append(filteredZfs, zfs)
@@ -198,6 +410,18 @@ func filterZfsInVms(zfsList []zfs, vmIDs []int) []zfs {
 	return filteredZfs
 }
 
+var vmidRE = regexp.MustCompile(`(?:^|/)(?:vm|subvol|base|basevol)-([0-9]+)-disk-`)
+
+// Get the VMID of a dataset, 0 if the dataset is not a guest disk
+func vmidOf(zfsName string) int {
+	submatch := vmidRE.FindStringSubmatch(zfsName)
+	if len(submatch) < 2 {
+		return 0
+	}
+	vmid, _ := strconv.Atoi(submatch[1])
+	return vmid
+}
+
 // Check if a zfs is in a list of zfs
 func containsZFS(zfsList []zfs, target zfs) bool {
 	for _, zfs := range zfsList {
@@ -237,8 +461,11 @@ func getPendingStartZFS(allZFS []zfs, runningZFS []zfs, hostname string) []zfs {
 }
 
 func processPendingsZFS(pending *Pending, pendingStopZFS []zfs, pendingStartZFS []zfs, env environment) {
+	naming := env.namingOf(pending.Pool)
 	for _, zfs := range pendingStopZFS {
-		pending.Snapshots = append(pending.Snapshots, fmt.Sprintf("%s@autosnap_%s_stopped", zfs.name, env.time.human))
+		name := fmt.Sprintf("%s@%s", zfs.name, naming.format(env.time.now, stopped))
+		pending.Snapshots = append(pending.Snapshots, name)
+		pending.Holds = append(pending.Holds, name)
 		pending.SetStopped = append(pending.SetStopped, zfs.name)
 	}
 	for _, zfs := range pendingStartZFS {
@@ -247,19 +474,44 @@ func processPendingsZFS(pending *Pending, pendingStopZFS []zfs, pendingStartZFS
 }
 
 // Split snapshots into groups by type
-func splitSnapshots(snapshots []snapshot) map[string][]snapshot {
+func splitSnapshots(snapshots []snapshot, naming naming) map[string][]snapshot {
 	group := make(map[string][]snapshot)
 	for _, snapshot := range snapshots {
-		submatch := snapshotTypeRE.FindStringSubmatch(snapshot.name)
-		if len(submatch) < 2 {
+		snapshotType, ok := naming.parse(snapshot.name)
+		if !ok {
 			continue
 		}
-		snapshotType := submatch[1]
 		group[snapshotType] = append(group[snapshotType], snapshot)
 	}
+	for _, snapshots := range group {
+		sortSnapshots(snapshots)
+	}
 	return group
 }
 
+// Sort snapshots from the oldest to the newest by createtxg, then by creation.
+// Snapshots of one channel program share a TXG, they are ordered by name.
+// If any createtxg is unknown, the whole slice is sorted by creation: mixing both keys is not transitive.
+func sortSnapshots(snapshots []snapshot) {
+	byTXG := true
+	for _, snapshot := range snapshots {
+		if snapshot.createtxg == 0 {
+			byTXG = false
+			break
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if byTXG && a.createtxg != b.createtxg {
+			return a.createtxg < b.createtxg
+		}
+		if a.creation != b.creation {
+			return a.creation < b.creation
+		}
+		return a.name < b.name
+	})
+}
+
 // Filter out nosnap datasets
 func filterNoSnap(zfsList []zfs) []zfs {
 	var filteredZFS []zfs
@@ -284,98 +536,76 @@ func snapshotsToNames(snapshots []snapshot) []string {
 func processSnapshots(
 	pending *Pending,
 	snapshots []snapshot,
-	zfsName string,
-	snapshotType string,
+	dataset zfs,
 	policy policy,
 	timeNowUnix int64,
-	timeNowHuman string,
+	snapshotName string,
 ) {
-	count := len(snapshots)
+	// Snapshots held by pins, clones or other tools neither count toward the tier nor are destroyed
+	rotating := rotatingSnapshots(snapshots)
+	count := len(rotating)
 	maxCount := policy.count
 	var timeLast int64
-	if count > 0 {
-		timeLast = snapshots[count-1].creation
+	var newest string
+	if len(snapshots) > 0 {
+		timeLast = snapshots[len(snapshots)-1].creation
+		newest = snapshots[len(snapshots)-1].name
 	}
 
 	if maxCount == 0 {
+		releaseAll(pending, snapshots)
 		pending.Destroys = append(
 			pending.Destroys,
-			snapshotsToNames(snapshots)...)
+			snapshotsToNames(rotating)...)
 		return
 	}
 
-	if timeLast+policy.interval < timeNowUnix+60 {
-		pending.Snapshots = append(
-			pending.Snapshots,
-			fmt.Sprintf("%s@autosnap_%s_%s", zfsName, timeNowHuman, snapshotType),
-		)
+	unchanged := policy.skipUnchanged && len(snapshots) > 0 && dataset.written <= policy.skipWritten
+	if timeLast+policy.interval < timeNowUnix+60 && !unchanged {
+		newest = fmt.Sprintf("%s@%s", dataset.name, snapshotName)
+		pending.Snapshots = append(pending.Snapshots, newest)
 		count++
 	}
+	keepNewest(pending, snapshots, newest)
 	if count > policy.count {
+		pending.countRotated(dataset.name)
 		pending.Destroys = append(
 			pending.Destroys,
-			snapshotsToNames(snapshots[:count-maxCount])...)
+			snapshotsToNames(rotating[:count-maxCount])...)
 	}
 }
 
 func main() {
-	err := checkCallLuaCode(os.Args)
-	checkErr(err)
-
-	env, err := getEnvironment(os.Args)
-	checkErr(err)
-
-	if isTerminal() {
-		fmt.Println("Running in terminal mode")
-		updateCron()
+	handled, err := checkCallLuaCode(os.Args)
+	exitOnError(err)
+	if handled {
+		os.Exit(exitOK)
 	}
 
+	ctx := context.Background()
 	executor := OSExec{}
 
-	poolList, err := ZpoolList(executor)
-	checkErr(err)
-
-	vms, err := GetVMs(executor, env.hostname)
-	checkErr(err)
-
-	allVMIDs := GetAllVMIDs(vms)
-	runningVMIDs := GetRunningVMIDs(vms)
-
-	for _, pool := range poolList {
-		pending := Pending{Pool: pool, Hosname: env.hostname}
-
-		allZFS, err := ZFSlist(executor, pool)
-		checkErr(err)
-
-		// All datasets related to VMs
-		allZFS = filterZfsInVms(allZFS, allVMIDs)
-
-		// Datasets related to running VMs
-		runningZFS := filterZfsInVms(allZFS, runningVMIDs)
-
-		pendingStopZFS := getPendingStopZFS(allZFS, runningZFS, env.hostname)
-		pendingStartZFS := getPendingStartZFS(allZFS, runningZFS, env.hostname)
-
-		processPendingsZFS(&pending, pendingStopZFS, pendingStartZFS, env)
+	if handled, err := runSubcommand(ctx, executor, os.Args); handled {
+		exitOnError(err)
+		os.Exit(exitOK)
+	}
 
-		// Filter nosnap datasets
-		runningZFS = filterNoSnap(runningZFS)
+	env, err := getEnvironment(os.Args)
+	exitOnError(err)
 
-		for _, zfs := range runningZFS {
-			snapshots, err := ZfsListSnapshots(executor, zfs.name)
-			checkErr(err)
+	if isTerminal() {
+		fmt.Println("Running in terminal mode")
+		if shouldUpdateCron(env) {
+			exitOnError(updateCron())
+		}
+	}
 
-			// Snapshots grouped by types and filtered by pattern
-			groupedSnapshots := splitSnapshots(snapshots)
+	source, err := getVMSource(executor, env.api)
+	exitOnError(err)
 
-			processSnapshots(&pending, groupedSnapshots[yearly], zfs.name, yearly, env.policy[yearly], env.time.unix, env.time.human)
-			processSnapshots(&pending, groupedSnapshots[monthly], zfs.name, monthly, env.policy[monthly], env.time.unix, env.time.human)
-			processSnapshots(&pending, groupedSnapshots[daily], zfs.name, daily, env.policy[daily], env.time.unix, env.time.human)
-			processSnapshots(&pending, groupedSnapshots[hourly], zfs.name, hourly, env.policy[hourly], env.time.unix, env.time.human)
-			processSnapshots(&pending, groupedSnapshots[frequently], zfs.name, frequently, env.policy[frequently], env.time.unix, env.time.human)
-			processSnapshots(&pending, groupedSnapshots[stopped], zfs.name, stopped, env.policy[stopped], env.time.unix, env.time.human)
-		}
-		err = pending.Run()
-		checkErr(err)
+	report, err := Run(ctx, env, deps{exec: executor, source: source})
+	if reportErr := saveReport(env.report, newReportFile(report, err, time.Now())); reportErr != nil {
+		err = errors.Join(err, reportErr)
 	}
+	exitOnError(err)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -11,6 +12,8 @@ func TestFilterZfsInVms(t *testing.T) {
 		{name: "vm-101-disk-1"},
 		{name: "subvol-102-disk-1"},
 		{name: "vm-103-disk-1"},
+		// A restore clone contains the disk name, but is not a guest disk
+		{name: "rpool/data/pve-zfs-snap-restore-1674547202-vm-100-disk-0"},
 	}
 	vmIDs := []int{100, 101, 102}
 	expected := []zfs{
@@ -22,6 +25,12 @@ func TestFilterZfsInVms(t *testing.T) {
 	if !reflect.DeepEqual(got, expected) {
 		t.Errorf("filterZfsInVms() = %v, want %v", got, expected)
 	}
+	if vmid := vmidOf("rpool/data/pve-zfs-snap-restore-1674547202-vm-100-disk-0"); vmid != 0 {
+		t.Errorf("vmidOf() of a restore clone = %d, want 0", vmid)
+	}
+	if vmid := vmidOf("rpool/data/base-102-disk-0"); vmid != 102 {
+		t.Errorf("vmidOf() = %d, want 102", vmid)
+	}
 }
 
 func TestFilterNoSnap(t *testing.T) {
@@ -107,67 +116,241 @@ func TestGetPendingStartZFS(t *testing.T) {
 
 func TestSplitSnapshots(t *testing.T) {
 	snapshots := []snapshot{
-		{"vm-100-disk-1@autosnap_2020-10-21_04:00:02_yearly", 1603252802},
-		{"vm-100-disk-1@autosnap_2021-10-21_04:00:02_yearly", 1634788802},
-		{"vm-100-disk-1@autosnap_2022-10-21_04:00:02_yearly", 1666324802},
-		{"vm-100-disk-1@autosnap_2022-10-21_04:00:02_monthly", 1666324802},
-		{"vm-100-disk-1@autosnap_2022-11-21_04:00:02_monthly", 1669003202},
-		{"vm-100-disk-1@autosnap_2022-12-21_04:00:02_monthly", 1671595202},
-		{"vm-100-disk-1@autosnap_2023-01-21_04:00:02_monthly", 1674273602},
-		{"vm-100-disk-1@autosnap_2023-01-22_04:00:02_daily", 1674360002},
-		{"vm-100-disk-1@autosnap_2023-01-23_04:00:02_daily", 1674446402},
-		{"vm-100-disk-1@autosnap_2023-01-24_04:00:02_daily", 1674532802},
-		{"vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", 1674536402},
-		{"vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", 1674540002},
-		{"vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly", 1674543602},
-		{"vm-100-disk-1@autosnap_2023-01-24_07:15:02_frequently", 1674544502},
-		{"vm-100-disk-1@autosnap_2023-01-24_07:30:02_frequently", 1674545402},
-		{"vm-100-disk-1@autosnap_2023-01-24_07:45:02_frequently", 1674546302},
-		{"vm-100-disk-1@autosnap_2023-01-24_08:00:02_frequently", 1674547202},
-		{"vm-100-disk-1@autosnap_2023-01-24_08:15:02_frequently", 1674548102},
-		{"vm-100-disk-1@autosnap_2023-01-24_08:30:02_frequently", 1674549002},
-		{"vm-100-disk-1@autosnap_2023-01-24_08:45:02_frequently", 1674549902},
-		{"vm-100-disk-1@autosnap_2023-01-24_09:00:02_frequently", 1674550802},
-		{"vm-100-disk-1@autosnap_2023-01-24_09:15:02_frequently", 1674551702},
-		{"vm-100-disk-1@autosnap_2023-01-24_09:30:02_frequently", 1674552602},
+		{name: "vm-100-disk-1@autosnap_2020-10-21_04:00:02_yearly", creation: 1603252802},
+		{name: "vm-100-disk-1@autosnap_2021-10-21_04:00:02_yearly", creation: 1634788802},
+		{name: "vm-100-disk-1@autosnap_2022-10-21_04:00:02_yearly", creation: 1666324802},
+		{name: "vm-100-disk-1@autosnap_2022-10-21_04:00:02_monthly", creation: 1666324802},
+		{name: "vm-100-disk-1@autosnap_2022-11-21_04:00:02_monthly", creation: 1669003202},
+		{name: "vm-100-disk-1@autosnap_2022-12-21_04:00:02_monthly", creation: 1671595202},
+		{name: "vm-100-disk-1@autosnap_2023-01-21_04:00:02_monthly", creation: 1674273602},
+		{name: "vm-100-disk-1@autosnap_2023-01-22_04:00:02_daily", creation: 1674360002},
+		{name: "vm-100-disk-1@autosnap_2023-01-23_04:00:02_daily", creation: 1674446402},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_04:00:02_daily", creation: 1674532802},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", creation: 1674536402},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly", creation: 1674543602},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:15:02_frequently", creation: 1674544502},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:30:02_frequently", creation: 1674545402},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:45:02_frequently", creation: 1674546302},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_08:00:02_frequently", creation: 1674547202},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_08:15:02_frequently", creation: 1674548102},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_08:30:02_frequently", creation: 1674549002},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_08:45:02_frequently", creation: 1674549902},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_09:00:02_frequently", creation: 1674550802},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_09:15:02_frequently", creation: 1674551702},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_09:30:02_frequently", creation: 1674552602},
 	}
 	expected := map[string][]snapshot{
 		"yearly": {
-			{"vm-100-disk-1@autosnap_2020-10-21_04:00:02_yearly", 1603252802},
-			{"vm-100-disk-1@autosnap_2021-10-21_04:00:02_yearly", 1634788802},
-			{"vm-100-disk-1@autosnap_2022-10-21_04:00:02_yearly", 1666324802},
+			{name: "vm-100-disk-1@autosnap_2020-10-21_04:00:02_yearly", creation: 1603252802},
+			{name: "vm-100-disk-1@autosnap_2021-10-21_04:00:02_yearly", creation: 1634788802},
+			{name: "vm-100-disk-1@autosnap_2022-10-21_04:00:02_yearly", creation: 1666324802},
 		},
 		"monthly": {
-			{"vm-100-disk-1@autosnap_2022-10-21_04:00:02_monthly", 1666324802},
-			{"vm-100-disk-1@autosnap_2022-11-21_04:00:02_monthly", 1669003202},
-			{"vm-100-disk-1@autosnap_2022-12-21_04:00:02_monthly", 1671595202},
-			{"vm-100-disk-1@autosnap_2023-01-21_04:00:02_monthly", 1674273602},
+			{name: "vm-100-disk-1@autosnap_2022-10-21_04:00:02_monthly", creation: 1666324802},
+			{name: "vm-100-disk-1@autosnap_2022-11-21_04:00:02_monthly", creation: 1669003202},
+			{name: "vm-100-disk-1@autosnap_2022-12-21_04:00:02_monthly", creation: 1671595202},
+			{name: "vm-100-disk-1@autosnap_2023-01-21_04:00:02_monthly", creation: 1674273602},
 		},
 		"daily": {
-			{"vm-100-disk-1@autosnap_2023-01-22_04:00:02_daily", 1674360002},
-			{"vm-100-disk-1@autosnap_2023-01-23_04:00:02_daily", 1674446402},
-			{"vm-100-disk-1@autosnap_2023-01-24_04:00:02_daily", 1674532802},
+			{name: "vm-100-disk-1@autosnap_2023-01-22_04:00:02_daily", creation: 1674360002},
+			{name: "vm-100-disk-1@autosnap_2023-01-23_04:00:02_daily", creation: 1674446402},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_04:00:02_daily", creation: 1674532802},
 		},
 		"hourly": {
-			{"vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", 1674536402},
-			{"vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", 1674540002},
-			{"vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly", 1674543602},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", creation: 1674536402},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly", creation: 1674543602},
 		},
 		"frequently": {
-			{"vm-100-disk-1@autosnap_2023-01-24_07:15:02_frequently", 1674544502},
-			{"vm-100-disk-1@autosnap_2023-01-24_07:30:02_frequently", 1674545402},
-			{"vm-100-disk-1@autosnap_2023-01-24_07:45:02_frequently", 1674546302},
-			{"vm-100-disk-1@autosnap_2023-01-24_08:00:02_frequently", 1674547202},
-			{"vm-100-disk-1@autosnap_2023-01-24_08:15:02_frequently", 1674548102},
-			{"vm-100-disk-1@autosnap_2023-01-24_08:30:02_frequently", 1674549002},
-			{"vm-100-disk-1@autosnap_2023-01-24_08:45:02_frequently", 1674549902},
-			{"vm-100-disk-1@autosnap_2023-01-24_09:00:02_frequently", 1674550802},
-			{"vm-100-disk-1@autosnap_2023-01-24_09:15:02_frequently", 1674551702},
-			{"vm-100-disk-1@autosnap_2023-01-24_09:30:02_frequently", 1674552602},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_07:15:02_frequently", creation: 1674544502},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_07:30:02_frequently", creation: 1674545402},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_07:45:02_frequently", creation: 1674546302},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_08:00:02_frequently", creation: 1674547202},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_08:15:02_frequently", creation: 1674548102},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_08:30:02_frequently", creation: 1674549002},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_08:45:02_frequently", creation: 1674549902},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_09:00:02_frequently", creation: 1674550802},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_09:15:02_frequently", creation: 1674551702},
+			{name: "vm-100-disk-1@autosnap_2023-01-24_09:30:02_frequently", creation: 1674552602},
 		},
 	}
-	got := splitSnapshots(snapshots)
+	got := splitSnapshots(snapshots, defaultNaming)
 	if !reflect.DeepEqual(got, expected) {
 		t.Errorf("splitSnapshots() = %v, want %v", got, expected)
 	}
 }
+
+func TestProcessSnapshotsHolds(t *testing.T) {
+	snapshots := []snapshot{
+		{name: "vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", creation: 1674536402},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002, holds: []string{keepTag}},
+	}
+	pending := Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1"}, policy{count: 2, interval: 3600}, 1674543602, "autosnap_2023-01-24_07:00:02_hourly")
+
+	expected := Pending{
+		Snapshots: []string{"vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly"},
+		Destroys:  []string{"vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly"},
+		Holds:     []string{"vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly"},
+		Releases:  []string{"vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly"},
+		Rotated:   map[string]int{"vm-100-disk-1": 1},
+	}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("processSnapshots() = %+v, want %+v", pending, expected)
+	}
+
+	// The newest snapshot is already held, nothing to do
+	pending = Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1"}, policy{count: 2, interval: 3600}, 1674540002, "autosnap_2023-01-24_06:00:02_hourly")
+	if !reflect.DeepEqual(pending, Pending{}) {
+		t.Errorf("processSnapshots() = %+v, want empty", pending)
+	}
+
+	// Disabled tier releases and destroys everything
+	pending = Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1"}, policy{count: 0}, 1674543602, "autosnap_2023-01-24_07:00:02_hourly")
+	expected = Pending{
+		Destroys: snapshotsToNames(snapshots),
+		Releases: []string{"vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly"},
+	}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("processSnapshots() = %+v, want %+v", pending, expected)
+	}
+}
+
+func TestProcessSnapshotsPinned(t *testing.T) {
+	snapshots := []snapshot{
+		{name: "vm-100-disk-1@autosnap_2023-01-24_04:00:02_hourly", creation: 1674532802, userrefs: 1, holds: []string{pinTag}},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", creation: 1674536402, userrefs: 1, holds: []string{cloneTag(200)}},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002, userrefs: 1, holds: []string{keepTag}},
+	}
+	// Pinned and cloned snapshots are outside the two kept snapshots
+	pending := Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1"}, policy{count: 2, interval: 3600}, 1674543602, "autosnap_2023-01-24_07:00:02_hourly")
+	if len(pending.Destroys) != 0 {
+		t.Errorf("Destroys = %v, want none", pending.Destroys)
+	}
+
+	// A disabled tier destroys only the rotated snapshots
+	pending = Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1"}, policy{count: 0}, 1674543602, "autosnap_2023-01-24_07:00:02_hourly")
+	if expected := []string{"vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly"}; !reflect.DeepEqual(pending.Destroys, expected) {
+		t.Errorf("Destroys = %v, want %v", pending.Destroys, expected)
+	}
+}
+
+func TestProcessSnapshotsSkipUnchanged(t *testing.T) {
+	snapshots := []snapshot{
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:00:02_frequently", creation: 1674543602, holds: []string{keepTag}},
+	}
+	skipPolicy := policy{count: 4, skipUnchanged: true, skipWritten: 4096}
+
+	pending := Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1", written: 4096}, skipPolicy, 1674544502, "autosnap_2023-01-24_07:15:02_frequently")
+	if len(pending.Snapshots) != 0 {
+		t.Errorf("expected unchanged dataset to be skipped, got %v", pending.Snapshots)
+	}
+
+	pending = Pending{}
+	processSnapshots(&pending, snapshots, zfs{name: "vm-100-disk-1", written: 4097}, skipPolicy, 1674544502, "autosnap_2023-01-24_07:15:02_frequently")
+	expected := []string{"vm-100-disk-1@autosnap_2023-01-24_07:15:02_frequently"}
+	if !reflect.DeepEqual(pending.Snapshots, expected) {
+		t.Errorf("Snapshots = %v, want %v", pending.Snapshots, expected)
+	}
+
+	// The first snapshot is always created
+	pending = Pending{}
+	processSnapshots(&pending, nil, zfs{name: "vm-100-disk-1"}, skipPolicy, 1674544502, "autosnap_2023-01-24_07:15:02_frequently")
+	if !reflect.DeepEqual(pending.Snapshots, expected) {
+		t.Errorf("Snapshots = %v, want %v", pending.Snapshots, expected)
+	}
+}
+
+func TestRetentionWithShuffledSnapshots(t *testing.T) {
+	ordered := []snapshot{
+		{name: "vm-100-disk-1@autosnap_2023-01-24_04:00:02_hourly", creation: 1674532802, createtxg: 100},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_05:00:02_hourly", creation: 1674536402, createtxg: 200},
+		// Clock went back, createtxg still orders the snapshots
+		{name: "vm-100-disk-1@autosnap_2023-01-24_04:30:00_hourly", creation: 1674534600, createtxg: 300},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002, createtxg: 400},
+		// Same TXG and creation, ordered by name
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:00:02_hourly", creation: 1674543602, createtxg: 500},
+		{name: "vm-100-disk-1@autosnap_2023-01-24_07:00:03_hourly", creation: 1674543602, createtxg: 500},
+	}
+	tests := []struct {
+		name     string
+		count    int
+		destroys []string
+	}{
+		{"keep 5", 5, snapshotsToNames(ordered[:2])},
+		{"keep 3", 3, snapshotsToNames(ordered[:4])},
+		{"keep 1", 1, snapshotsToNames(ordered[:6])},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			shuffled := append([]snapshot(nil), ordered...)
+			rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+			grouped := splitSnapshots(shuffled, defaultNaming)
+			if !reflect.DeepEqual(grouped[hourly], ordered) {
+				t.Fatalf("%s: splitSnapshots() = %v, want %v", tt.name, grouped[hourly], ordered)
+			}
+			pending := Pending{}
+			processSnapshots(&pending, grouped[hourly], zfs{name: "vm-100-disk-1"}, policy{count: tt.count, interval: 3600}, 1674547202, "autosnap_2023-01-24_08:00:02_hourly")
+			if !reflect.DeepEqual(pending.Destroys, tt.destroys) {
+				t.Errorf("%s: Destroys = %v, want %v", tt.name, pending.Destroys, tt.destroys)
+			}
+		}
+	}
+}
+
+func TestSortSnapshotsMissingCreatetxg(t *testing.T) {
+	// One snapshot without createtxg: the TXG order (a, c) and the creation order (c, b, a)
+	// disagree, the whole slice falls back to creation
+	ordered := []snapshot{
+		{name: "vm-100-disk-1@c", creation: 100, createtxg: 20},
+		{name: "vm-100-disk-1@b", creation: 200},
+		{name: "vm-100-disk-1@a", creation: 300, createtxg: 10},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		shuffled := append([]snapshot(nil), ordered...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		sortSnapshots(shuffled)
+		if !reflect.DeepEqual(shuffled, ordered) {
+			t.Fatalf("sortSnapshots() = %v, want %v", shuffled, ordered)
+		}
+	}
+}
+
+func TestCheckCallLuaCode(t *testing.T) {
+	if handled, err := checkCallLuaCode([]string{"pve-zfs-snap", "lua_hello"}); !handled || err != nil {
+		t.Errorf("checkCallLuaCode(lua_hello) = %v, %v", handled, err)
+	}
+	if handled, err := checkCallLuaCode([]string{"pve-zfs-snap", "h24"}); handled || err != nil {
+		t.Errorf("checkCallLuaCode(h24) = %v, %v", handled, err)
+	}
+	if _, err := checkCallLuaCode([]string{"pve-zfs-snap"}); exitCode(err) != exitUsage {
+		t.Errorf("expected a usage error without parameters, got %v", err)
+	}
+}
+
+func TestShouldUpdateCron(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected bool
+	}{
+		{[]string{"pve-zfs-snap", "h24"}, true},
+		{[]string{"pve-zfs-snap", "h0", "--dry-run"}, false},
+	} {
+		env, err := getEnvironment(test.args)
+		if err != nil {
+			t.Fatalf("getEnvironment(%v) returned error: %v", test.args, err)
+		}
+		if got := shouldUpdateCron(env); got != test.expected {
+			t.Errorf("shouldUpdateCron(%v) = %v, want %v", test.args, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Naming scheme of snapshots
+type namingScheme interface {
+	// Parse the short name of a snapshot (after @) and return its tier
+	parse(name string) (tier string, ok bool)
+	// Format the short name of a new snapshot
+	format(t time.Time, tier string) string
+}
+
+// Prefix, time layout and time zone of snapshot names
+type snapshotFormat struct {
+	prefix   string
+	layout   string // Go time layout
+	location *time.Location
+}
+
+// UTC by default: names in local time repeat when the clock is set back at the end of DST
+var defaultSnapshotFormat = snapshotFormat{
+	prefix:   "autosnap",
+	layout:   "2006-01-02_15:04:05",
+	location: time.UTC,
+}
+
+// Names like autosnap_2023-10-19_10:00:00_hourly, the format of this program and sanoid
+type autosnapScheme struct {
+	style snapshotFormat
+	// Regular expression to match snapshot types, derived from the format
+	re *regexp.Regexp
+	// Foreign tiers adopted into the retention tiers, e.g. weekly of sanoid
+	aliases map[string]string
+}
+
+func newAutosnapScheme(style snapshotFormat, aliases map[string]string) autosnapScheme {
+	return autosnapScheme{
+		style:   style,
+		re:      regexp.MustCompile("^" + regexp.QuoteMeta(style.prefix+"_") + "(" + layoutRE(style.layout) + ")_([a-z]+)$"),
+		aliases: aliases,
+	}
+}
+
+// Elements of Go time layouts supported in snapshot names
+var layoutElements = []struct {
+	element string
+	re      string
+}{
+	{"2006", `[0-9]{4}`},
+	{"01", `[0-9]{2}`},
+	{"02", `[0-9]{2}`},
+	{"15", `[0-9]{2}`},
+	{"04", `[0-9]{2}`},
+	{"05", `[0-9]{2}`},
+}
+
+// Convert a Go time layout into a regular expression
+func layoutRE(layout string) string {
+	var re strings.Builder
+	for len(layout) > 0 {
+		matched := false
+		for _, e := range layoutElements {
+			if strings.HasPrefix(layout, e.element) {
+				re.WriteString(e.re)
+				layout = layout[len(e.element):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			re.WriteString(regexp.QuoteMeta(layout[:1]))
+			layout = layout[1:]
+		}
+	}
+	return re.String()
+}
+
+func (s autosnapScheme) parse(name string) (string, bool) {
+	submatch := s.re.FindStringSubmatch(name)
+	if len(submatch) < 3 {
+		return "", false
+	}
+	if _, err := time.ParseInLocation(s.style.layout, submatch[1], s.style.location); err != nil {
+		return "", false
+	}
+	return adoptTier(submatch[2], s.aliases)
+}
+
+func (s autosnapScheme) format(t time.Time, tier string) string {
+	return fmt.Sprintf("%s_%s_%s", s.style.prefix, t.In(s.style.location).Format(s.style.layout), tier)
+}
+
+var validSnapshotNameRE = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// Check that names of the format are valid and parsed back
+func (style snapshotFormat) check() error {
+	scheme := newAutosnapScheme(style, nil)
+	name := scheme.format(time.Date(2023, 12, 31, 23, 59, 58, 0, time.UTC), frequently)
+	if !validSnapshotNameRE.MatchString(name) {
+		return fmt.Errorf("snapshot name '%s' has characters not allowed by ZFS", name)
+	}
+	if tier, ok := scheme.parse(name); !ok || tier != frequently {
+		return fmt.Errorf("snapshot name '%s' can not be parsed back, the time format supports only 2006 01 02 15 04 05", name)
+	}
+	return nil
+}
+
+// Names like zfs-auto-snap_hourly-2023-10-19-1017 of zfs-auto-snapshot
+type zfsAutoSnapshotScheme struct{}
+
+var zfsAutoSnapRE = regexp.MustCompile(`^zfs-auto-snap_([a-z]+)-[0-9]{4}-[0-9]{2}-[0-9]{2}-[0-9]{4}$`)
+
+var zfsAutoSnapTiers = map[string]string{
+	"frequent": frequently,
+	"hourly":   hourly,
+	"daily":    daily,
+	"weekly":   daily,
+	"monthly":  monthly,
+	"yearly":   yearly,
+	"stopped":  stopped,
+}
+
+func (s zfsAutoSnapshotScheme) parse(name string) (string, bool) {
+	submatch := zfsAutoSnapRE.FindStringSubmatch(name)
+	if len(submatch) < 2 {
+		return "", false
+	}
+	return adoptTier(submatch[1], zfsAutoSnapTiers)
+}
+
+func (s zfsAutoSnapshotScheme) format(t time.Time, tier string) string {
+	if tier == frequently {
+		tier = "frequent"
+	}
+	return fmt.Sprintf("zfs-auto-snap_%s-%s", tier, t.Format("2006-01-02-1504"))
+}
+
+// Map a tier of a scheme to a retention tier, unknown tiers are left alone
+func adoptTier(tier string, aliases map[string]string) (string, bool) {
+	if alias, ok := aliases[tier]; ok {
+		tier = alias
+	}
+	for _, known := range tiers {
+		if tier == known {
+			return tier, true
+		}
+	}
+	return "", false
+}
+
+// Get a naming scheme by name, the format applies to the autosnap scheme of this program
+func getNamingScheme(name string, style snapshotFormat) (namingScheme, bool) {
+	switch name {
+	case "autosnap":
+		return newAutosnapScheme(style, nil), true
+	case "sanoid":
+		return newAutosnapScheme(defaultSnapshotFormat, map[string]string{"weekly": daily}), true
+	case "zfs-auto-snapshot":
+		return zfsAutoSnapshotScheme{}, true
+	}
+	return nil, false
+}
+
+// Naming of a pool. New snapshots are named by the first scheme,
+// snapshots of the other schemes are adopted into the retention tiers and age out
+type naming []namingScheme
+
+var defaultNaming = naming{newAutosnapScheme(defaultSnapshotFormat, nil)}
+
+// Parse the tier of a full snapshot name
+func (n naming) parse(name string) (string, bool) {
+	_, short, ok := strings.Cut(name, "@")
+	if !ok {
+		return "", false
+	}
+	for _, scheme := range n {
+		if tier, ok := scheme.parse(short); ok {
+			return tier, true
+		}
+	}
+	return "", false
+}
+
+func (n naming) format(t time.Time, tier string) string {
+	return n[0].format(t, tier)
+}
+
+var legacyNaming = naming{newAutosnapScheme(defaultSnapshotFormat, nil)}
+
+// Count the snapshots of the default format which the naming does not parse. They are left
+// after --prefix or --time-format changed and are never pruned unless the sanoid scheme adopts them
+func (n naming) countLegacy(snapshots []snapshot) int {
+	count := 0
+	for _, snapshot := range snapshots {
+		if _, ok := n.parse(snapshot.name); ok {
+			continue
+		}
+		if _, ok := legacyNaming.parse(snapshot.name); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// Parse '[<pool>:]<scheme>[+<scheme>...]'
+func parseNamingOption(arg string, value string, target map[string][]string) error {
+	pool, schemes, ok := strings.Cut(value, ":")
+	if !ok {
+		pool, schemes = "", value
+	}
+	names := strings.Split(schemes, "+")
+	for _, name := range names {
+		if _, ok := getNamingScheme(name, defaultSnapshotFormat); !ok {
+			return fmt.Errorf("option '%s' has unknown naming scheme '%s'", arg, name)
+		}
+	}
+	target[pool] = names
+	return nil
+}
+
+// Get the naming of a pool
+func (env environment) namingOf(pool string) naming {
+	names, ok := env.naming[pool]
+	if !ok {
+		names, ok = env.naming[""]
+	}
+	if !ok {
+		names = []string{"autosnap"}
+	}
+	var n naming
+	for _, name := range names {
+		scheme, _ := getNamingScheme(name, env.format)
+		n = append(n, scheme)
+	}
+	return n
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNamingAdoptsForeignSnapshots(t *testing.T) {
+	env := environment{naming: make(map[string][]string), format: defaultSnapshotFormat}
+	if err := parseNamingOption("--naming", "rpool:autosnap+sanoid+zfs-auto-snapshot", env.naming); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	snapshots := []snapshot{
+		{name: "rpool/vm-100-disk-0@zfs-auto-snap_hourly-2023-01-24-0417", creation: 1674533820},
+		{name: "rpool/vm-100-disk-0@zfs-auto-snap_frequent-2023-01-24-0430", creation: 1674534600},
+		{name: "rpool/vm-100-disk-0@zfs-auto-snap_weekly-2023-01-22-0447", creation: 1674362820},
+		{name: "rpool/vm-100-disk-0@autosnap_2023-01-24_05:00:02_weekly", creation: 1674536402},
+		{name: "rpool/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002},
+		{name: "rpool/vm-100-disk-0@manual-before-upgrade", creation: 1674540003},
+	}
+	expected := map[string][]snapshot{
+		hourly: {
+			{name: "rpool/vm-100-disk-0@zfs-auto-snap_hourly-2023-01-24-0417", creation: 1674533820},
+			{name: "rpool/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly", creation: 1674540002},
+		},
+		frequently: {
+			{name: "rpool/vm-100-disk-0@zfs-auto-snap_frequent-2023-01-24-0430", creation: 1674534600},
+		},
+		daily: {
+			{name: "rpool/vm-100-disk-0@zfs-auto-snap_weekly-2023-01-22-0447", creation: 1674362820},
+			{name: "rpool/vm-100-disk-0@autosnap_2023-01-24_05:00:02_weekly", creation: 1674536402},
+		},
+	}
+	got := splitSnapshots(snapshots, env.namingOf("rpool"))
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("splitSnapshots() = %v, want %v", got, expected)
+	}
+
+	// Other pools keep the default naming
+	if got := splitSnapshots(snapshots, env.namingOf("tank")); len(got) != 1 || len(got[hourly]) != 1 {
+		t.Errorf("splitSnapshots() with default naming = %v", got)
+	}
+}
+
+func TestNamingFormat(t *testing.T) {
+	now := time.Date(2023, 1, 24, 7, 15, 2, 0, time.UTC)
+	autosnap, _ := getNamingScheme("autosnap", defaultSnapshotFormat)
+	zfsAutoSnapshot, _ := getNamingScheme("zfs-auto-snapshot", defaultSnapshotFormat)
+	if got := autosnap.format(now, hourly); got != "autosnap_2023-01-24_07:15:02_hourly" {
+		t.Errorf("autosnap format = %s", got)
+	}
+	if got := zfsAutoSnapshot.format(now, frequently); got != "zfs-auto-snap_frequent-2023-01-24-0715" {
+		t.Errorf("zfs-auto-snapshot format = %s", got)
+	}
+	if err := parseNamingOption("--naming", "unknown", map[string][]string{}); err == nil {
+		t.Errorf("expected error for an unknown scheme")
+	}
+}
+
+func TestConfiguredFormat(t *testing.T) {
+	env, err := getEnvironment([]string{"pve-zfs-snap", "h24", "--prefix=pvesnap", "--time-format=20060102T150405", "--time-zone=UTC"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := env.namingOf("rpool")
+	now := time.Date(2023, 3, 26, 2, 30, 0, 0, time.FixedZone("MSK", 3*3600))
+	name := n.format(now, hourly)
+	if name != "pvesnap_20230325T233000_hourly" {
+		t.Errorf("format() = %s", name)
+	}
+	if tier, ok := n.parse("rpool/vm-100-disk-0@" + name); !ok || tier != hourly {
+		t.Errorf("parse(%s) = %s, %v", name, tier, ok)
+	}
+	// Names of the default format are foreign now
+	if _, ok := n.parse("rpool/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly"); ok {
+		t.Errorf("default format must not be parsed")
+	}
+	snapshots := []snapshot{
+		{name: "rpool/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly"},
+		{name: "rpool/vm-100-disk-0@" + name},
+		{name: "rpool/vm-100-disk-0@manual"},
+	}
+	if got := n.countLegacy(snapshots); got != 1 {
+		t.Errorf("countLegacy() = %d, want 1", got)
+	}
+	if got := defaultNaming.countLegacy(snapshots); got != 0 {
+		t.Errorf("countLegacy() of the default naming = %d, want 0", got)
+	}
+
+	for _, arg := range []string{"--time-format=2006/01/02", "--time-format=Jan 2", "--prefix=a b", "--time-zone=Nowhere/City"} {
+		if _, err := getEnvironment([]string{"pve-zfs-snap", "h24", arg}); err == nil {
+			t.Errorf("expected error for %s", arg)
+		}
+	}
+}
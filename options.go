@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse an option in the format '--<name>' or '--<name>=<value>'
+func (env *environment) setOption(arg string) error {
+	name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+	switch name {
+	case "force-prune":
+		env.guard.force = true
+	case "max-destroy":
+		return parseIntOption(arg, value, &env.guard.maxCount)
+	case "max-destroy-percent":
+		return parseIntOption(arg, value, &env.guard.maxPercent)
+	case "dry-run":
+		env.dryRun = true
+	case "space-high":
+		return parseIntOption(arg, value, &env.space.high)
+	case "space-low":
+		return parseIntOption(arg, value, &env.space.low)
+	case "space-min":
+		return parseTierCounts(arg, value, env.space.min)
+	case "freeze":
+		return parseFreezeOption(arg, value, &env.freeze)
+	case "freeze-timeout":
+		return parseIntOption(arg, value, &env.freeze.timeout)
+	case "pre-hook":
+		return parseHookOption(arg, value, &env.hooks.pre)
+	case "post-hook":
+		return parseHookOption(arg, value, &env.hooks.post)
+	case "hook-timeout":
+		return parseIntOption(arg, value, &env.hooks.timeout)
+	case "hook-failure":
+		switch value {
+		case "skip":
+			env.hooks.abort = false
+		case "abort":
+			env.hooks.abort = true
+		default:
+			return fmt.Errorf("option '%s' must be 'skip' or 'abort'", arg)
+		}
+	case "node":
+		env.node = value
+	case "api-url":
+		env.api.url = value
+	case "api-token-file":
+		env.api.tokenFile = value
+	case "api-ca":
+		env.api.caFile = value
+	case "api-fingerprint":
+		env.api.fingerprint = value
+	case "naming":
+		return parseNamingOption(arg, value, env.naming)
+	case "prefix":
+		env.format.prefix = value
+	case "time-format":
+		env.format.layout = value
+	case "time-zone":
+		location, err := time.LoadLocation(value)
+		if err != nil {
+			return fmt.Errorf("option '%s' has unknown time zone: %v", arg, err)
+		}
+		env.format.location = location
+	case "parallel":
+		if err := parseIntOption(arg, value, &env.parallel); err != nil {
+			return err
+		}
+		if env.parallel == 0 {
+			return fmt.Errorf("option '%s' must be at least 1", arg)
+		}
+	case "pool-timeout":
+		return parseIntOption(arg, value, &env.poolTimeout)
+	case "report-dir":
+		env.report.dir = value
+	case "report-keep":
+		return parseIntOption(arg, value, &env.report.keep)
+	case "pool", "exclude-pool", "include-dataset", "exclude-dataset":
+		_, err := env.filter.setOption(arg, name, value)
+		return err
+	case "template-policy":
+		return parseTemplatePolicy(arg, value, &env.templatePolicy)
+	case "skip-unchanged":
+		return parseTierCounts(arg, value, env.skipUnchanged)
+	default:
+		return fmt.Errorf("unknown option '%s'", arg)
+	}
+	return nil
+}
+
+func parseIntOption(arg string, value string, target *int) error {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return fmt.Errorf("option '%s' requires a non-negative number", arg)
+	}
+	*target = i
+	return nil
+}
+
+// Parse a comma separated list of '<one_letter><int>' items, e.g. 'h12,d7'
+func parseTierCounts(arg string, value string, target map[string]int) error {
+	for _, item := range strings.Split(value, ",") {
+		tier, ok := tierByKey[item[:min(len(item), 1)]]
+		i, err := strconv.Atoi(item[min(len(item), 1):])
+		if !ok || err != nil || i < 0 {
+			return fmt.Errorf("option '%s' has invalid item '%s'", arg, item)
+		}
+		target[tier] = i
+	}
+	return nil
+}
+
+// Options which must not be saved in cron
+func isOneShotOption(arg string) bool {
+	return arg == "--force-prune" || arg == "--dry-run"
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State of a pool during a run
+type poolRun struct {
+	pool    string
+	timeout time.Duration // of every step, 0 - no limit
+	pending *Pending
+	err     error
+}
+
+// Create runs of pools, each pool has its own timeout
+func newPoolRuns(pools []string, timeout int) []*poolRun {
+	runs := make([]*poolRun, len(pools))
+	for i, pool := range pools {
+		runs[i] = &poolRun{pool: pool, timeout: time.Duration(timeout) * time.Second}
+	}
+	return runs
+}
+
+// Get the context of a step of the pool. The deadline starts when the pool gets its slot,
+// so waiting for other pools, hooks and freezing does not count against it.
+func (run *poolRun) step(ctx context.Context) (context.Context, context.CancelFunc) {
+	if run.timeout > 0 {
+		return context.WithTimeout(ctx, run.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Run fn for every pool without errors, at most limit pools at once, each with the timeout of the pool.
+// A failed pool is skipped by the next steps and does not stop the other pools.
+func forEachPool(ctx context.Context, runs []*poolRun, limit int, fn func(ctx context.Context, run *poolRun) error) {
+	semaphore := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		if run.err != nil {
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(run *poolRun) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			ctx, cancel := run.step(ctx)
+			defer cancel()
+			if err := fn(ctx, run); err != nil {
+				run.err = fmt.Errorf("pool %s: %w", run.pool, err)
+			}
+		}(run)
+	}
+	wg.Wait()
+}
+
+// Get pending operations of the pools without errors
+func plannedPendings(runs []*poolRun) []*Pending {
+	var pendings []*Pending
+	for _, run := range runs {
+		if run.err == nil {
+			pendings = append(pendings, run.pending)
+		}
+	}
+	return pendings
+}
+
+// Join errors of all pools
+func poolErrors(runs []*poolRun) error {
+	var errs []error
+	for _, run := range runs {
+		if run.err != nil {
+			errs = append(errs, run.err)
+		}
+	}
+	return errors.Join(errs...)
+}
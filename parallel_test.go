@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEachPool(t *testing.T) {
+	runs := newPoolRuns([]string{"rpool", "tank", "backup", "nvme"}, 0)
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	forEachPool(context.Background(), runs, 2, func(ctx context.Context, run *poolRun) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		if run.pool == "tank" {
+			return fmt.Errorf("zfs list failed")
+		}
+		return nil
+	})
+	if maxRunning > 2 {
+		t.Errorf("%d pools were processed at once, limit is 2", maxRunning)
+	}
+
+	// The failed pool is skipped by the next step, the others continue
+	var processed []string
+	forEachPool(context.Background(), runs, 1, func(ctx context.Context, run *poolRun) error {
+		processed = append(processed, run.pool)
+		if run.pool == "nvme" {
+			return fmt.Errorf("program failed")
+		}
+		return nil
+	})
+	if len(processed) != 3 {
+		t.Errorf("processed = %v, want 3 pools", processed)
+	}
+
+	err := poolErrors(runs)
+	if err == nil || err.Error() != "pool tank: zfs list failed\npool nvme: program failed" {
+		t.Errorf("poolErrors() = %v", err)
+	}
+	if len(plannedPendings(runs)) != 2 {
+		t.Errorf("expected pendings of 2 pools")
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	runs := newPoolRuns([]string{"slow"}, 1)
+
+	forEachPool(context.Background(), runs, 1, func(ctx context.Context, run *poolRun) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(poolErrors(runs), context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", poolErrors(runs))
+	}
+}
+
+func TestPoolTimeoutPerStep(t *testing.T) {
+	runs := newPoolRuns([]string{"rpool", "tank"}, 1)
+
+	// tank waits for the slot of rpool, the wait does not count against its timeout
+	for step := 0; step < 2; step++ {
+		forEachPool(context.Background(), runs, 1, func(ctx context.Context, run *poolRun) error {
+			deadline, ok := ctx.Deadline()
+			if !ok || time.Until(deadline) < 900*time.Millisecond {
+				return fmt.Errorf("step %d started with %v left", step, time.Until(deadline))
+			}
+			time.Sleep(600 * time.Millisecond)
+			return nil
+		})
+	}
+	if err := poolErrors(runs); err != nil {
+		t.Errorf("poolErrors() = %v", err)
+	}
+}
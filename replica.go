@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Get why a dataset is a received replica from its zfs list columns and the source of its readonly:
+// label:role=replica, an interrupted receive or readonly=on which was received or inherited.
+// readonly=on set locally is no evidence of a receive, admins set it on archives as well.
+func replicaOf(line []string, readonlySource string) string {
+	switch {
+	case len(line) > 7 && line[7] == "replica":
+		return "label:role=replica"
+	case len(line) > 6 && line[6] != "-":
+		return "receiving"
+	case len(line) > 5 && line[5] == "on" && (readonlySource == "received" || strings.HasPrefix(readonlySource, "inherited")):
+		return "readonly (" + readonlySource + ")"
+	}
+	return ""
+}
+
+// Parts of a guest config a run needs
+type guestConfig struct {
+	volumes map[string]bool // datasets of the ZFS volumes
+	lock    string          // PVE lock of the guest, e.g. backup
+}
+
+// Configs of the guests of the node by VMID, nil for a guest without a config
+type guestConfigs map[int]*guestConfig
+
+// Read the configs of the guests of the node. On a backup node the same VMID can exist
+// as a received replica on another pool, the config tells which datasets the guest really uses.
+// Returns nil if the cluster file system is not mounted, then the configs are not checked.
+func readGuestConfigs(node string, vms []VM) (guestConfigs, error) {
+	if _, err := os.Stat(filepath.Join(pveNodesDir, node)); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	storages, err := zfsStorages(pveStorageConfig)
+	if err != nil {
+		return nil, err
+	}
+	configs := make(guestConfigs)
+	for _, vm := range vms {
+		config, err := os.ReadFile(guestConfigPath(node, vm.Type, vm.VMID))
+		if errors.Is(err, os.ErrNotExist) {
+			configs[vm.VMID] = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		configs[vm.VMID] = parseGuestConfig(string(config), storages)
+	}
+	return configs, nil
+}
+
+// Log that readGuestConfigs found no configs, so disks are not checked against them
+func logUncheckedConfigs(node string) {
+	fmt.Printf("%s does not exist, the cluster file system is not mounted, guest configs are not checked\n", filepath.Join(pveNodesDir, node))
+}
+
+// Get the datasets of the ZFS volumes of a guest config, including the sections of PVE snapshots,
+// and the lock of the guest
+func parseGuestConfig(config string, storages map[string]string) *guestConfig {
+	parsed := &guestConfig{volumes: make(map[string]bool)}
+	section := false
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "[") {
+			section = true
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		if key == "lock" && !section {
+			parsed.lock = value
+		}
+		volume, _, _ := strings.Cut(value, ",")
+		storage, name, ok := strings.Cut(volume, ":")
+		if pool, zfsStorage := storages[storage]; ok && zfsStorage {
+			parsed.volumes[pool+"/"+name] = true
+		}
+	}
+	return parsed
+}
+
+// Mark the disks of the guests of the node which their configs do not reference
+func markReplicas(zfsList []zfs, configs guestConfigs) []zfs {
+	marked := make([]zfs, len(zfsList))
+	for i, zfs := range zfsList {
+		config, ok := configs[vmidOf(zfs.name)]
+		switch {
+		case zfs.replica != "" || !ok:
+		case config == nil:
+			zfs.replica = "no guest config"
+		case !config.volumes[zfs.name]:
+			zfs.replica = "not in guest config"
+		}
+		marked[i] = zfs
+	}
+	return marked
+}
+
+// Drop received replicas: their snapshots come from the sending side,
+// a local snapshot breaks the next incremental receive
+func filterReplicas(zfsList []zfs) []zfs {
+	var filtered []zfs
+	for _, zfs := range zfsList {
+		if zfs.replica == "" {
+			filtered = append(filtered, zfs)
+		}
+	}
+	return filtered
+}
+
+// Log the guest disks a run skips as replicas and the readonly ones it snapshots
+func logReplicas(zfsList []zfs) {
+	for _, zfs := range zfsList {
+		switch {
+		case vmidOf(zfs.name) == 0:
+		case zfs.replica != "":
+			fmt.Printf("skipping %s, it is a received replica: %s\n", zfs.name, zfs.replica)
+		case zfs.readonly:
+			fmt.Printf("%s is readonly=on without signs of a receive, it is not treated as a replica\n", zfs.name)
+		}
+	}
+}
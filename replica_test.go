@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Use a temporary cluster file system with the configs of the guests of node HOST-1
+func newReplicaTestDir(t *testing.T, configs map[string]string) {
+	dir := t.TempDir()
+	originalNodes, originalStorage := pveNodesDir, pveStorageConfig
+	pveNodesDir, pveStorageConfig = dir, "testdata/storage.cfg"
+	t.Cleanup(func() { pveNodesDir, pveStorageConfig = originalNodes, originalStorage })
+	for _, guestDir := range []string{"qemu-server", "lxc"} {
+		if err := os.MkdirAll(filepath.Join(dir, "HOST-1", guestDir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, config := range configs {
+		if err := os.WriteFile(filepath.Join(dir, "HOST-1", name), []byte(config), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplicaOf(t *testing.T) {
+	tests := []struct {
+		line           []string
+		readonlySource string
+		expected       string
+	}{
+		{[]string{"rpool/data/vm-100-disk-0"}, "", ""},
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "off", "-", "-"}, "default", ""},
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "on", "-", "-"}, "received", "readonly (received)"},
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "on", "-", "-"}, "inherited from rpool/data", "readonly (inherited from rpool/data)"},
+		// Set locally or by a read-only mount, no evidence of a receive
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "on", "-", "-"}, "local", ""},
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "on", "-", "-"}, "temporary", ""},
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "off", "1-e5d4b2a4c-c0-789c", "-"}, "default", "receiving"},
+		{[]string{"rpool/data/vm-100-disk-0", "-", "-", "0", "-", "off", "-", "replica"}, "default", "label:role=replica"},
+	}
+	for _, test := range tests {
+		if replica := replicaOf(test.line, test.readonlySource); replica != test.expected {
+			t.Errorf("replicaOf(%v, %s) = %q, want %q", test.line, test.readonlySource, replica, test.expected)
+		}
+	}
+}
+
+func TestParseGuestConfig(t *testing.T) {
+	config := "boot: order=scsi0\n" +
+		"lock: backup\n" +
+		"net0: virtio=BC:24:11:00:00:01,bridge=vmbr0\n" +
+		"scsi0: local-zfs:vm-100-disk-0,iothread=1,size=32G\n" +
+		"scsi1: local-lvm:vm-100-disk-1,size=8G\n" +
+		"unused0: tank-zfs:vm-100-disk-2\n" +
+		"\n" +
+		"[before-upgrade]\n" +
+		"lock: snapshot\n" +
+		"scsi2: local-zfs:vm-100-disk-3,size=4G\n"
+	storages := map[string]string{"local-zfs": "rpool/data", "tank-zfs": "tank/pve"}
+	expected := &guestConfig{
+		volumes: map[string]bool{
+			"rpool/data/vm-100-disk-0": true,
+			"tank/pve/vm-100-disk-2":   true,
+			"rpool/data/vm-100-disk-3": true,
+		},
+		lock: "backup",
+	}
+	if parsed := parseGuestConfig(config, storages); !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("parseGuestConfig() = %+v, want %+v", parsed, expected)
+	}
+}
+
+func TestReadGuestConfigs(t *testing.T) {
+	vms := []VM{{VMID: 100, Type: "qemu"}, {VMID: 101, Type: "lxc"}}
+	newReplicaTestDir(t, map[string]string{"qemu-server/100.conf": "scsi0: local-zfs:vm-100-disk-0,size=32G\n"})
+	configs, err := readGuestConfigs("HOST-1", vms)
+	if err != nil {
+		t.Fatalf("readGuestConfigs returned error: %v", err)
+	}
+	expected := guestConfigs{100: {volumes: map[string]bool{"rpool/data/vm-100-disk-0": true}}, 101: nil}
+	if !reflect.DeepEqual(configs, expected) {
+		t.Errorf("readGuestConfigs() = %v, want %v", configs, expected)
+	}
+
+	// Without the cluster file system the configs are not checked
+	pveNodesDir = filepath.Join(t.TempDir(), "missing")
+	configs, err = readGuestConfigs("HOST-1", vms)
+	if err != nil || configs != nil {
+		t.Errorf("readGuestConfigs() = %v, %v, want nil", configs, err)
+	}
+}
+
+func TestMarkReplicas(t *testing.T) {
+	zfsList := []zfs{
+		{name: "rpool/data/vm-100-disk-0"},
+		{name: "tank/replica/vm-100-disk-0"},
+		{name: "rpool/data/subvol-101-disk-0"},
+		{name: "rpool/data/vm-102-disk-0", replica: "readonly (received)"},
+		{name: "rpool/data/vm-103-disk-0", readonly: true},
+	}
+	configs := guestConfigs{
+		100: {volumes: map[string]bool{"rpool/data/vm-100-disk-0": true}},
+		101: nil,
+		102: {volumes: map[string]bool{"rpool/data/vm-102-disk-0": true}},
+	}
+	expected := []zfs{
+		{name: "rpool/data/vm-100-disk-0"},
+		{name: "tank/replica/vm-100-disk-0", replica: "not in guest config"},
+		{name: "rpool/data/subvol-101-disk-0", replica: "no guest config"},
+		{name: "rpool/data/vm-102-disk-0", replica: "readonly (received)"},
+		{name: "rpool/data/vm-103-disk-0", readonly: true},
+	}
+	if marked := markReplicas(zfsList, configs); !reflect.DeepEqual(marked, expected) {
+		t.Errorf("markReplicas() = %v, want %v", marked, expected)
+	}
+	if replicas := filterReplicas(expected); !reflect.DeepEqual(replicas, []zfs{expected[0], expected[4]}) {
+		t.Errorf("filterReplicas() = %v", replicas)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const reportPrefix = "pve-zfs-snap-"
+
+type reportPolicy struct {
+	dir  string // directory of report files, "" - reports are disabled
+	keep int    // number of report files kept in the directory
+}
+
+// Report file of a run
+type reportFile struct {
+	Start  time.Time      `json:"start"`
+	End    time.Time      `json:"end"`
+	Host   string         `json:"host"`
+	DryRun bool           `json:"dry_run"`
+	Policy map[string]int `json:"policy"`
+	Pools  []poolReport   `json:"pools"`
+	Errors []string       `json:"errors"`
+	// Locks of the guests deferred to the next run by VMID
+	Deferred map[int]string `json:"deferred"`
+}
+
+type poolReport struct {
+	Pool        string            `json:"pool"`
+	Snapshots   []string          `json:"snapshots"` // planned
+	Destroys    []string          `json:"destroys"`  // planned
+	Created     []string          `json:"created"`
+	Destroyed   []string          `json:"destroyed"`
+	SpacePrunes []string          `json:"space_prunes"`
+	Held        []string          `json:"held"`
+	SetRunning  []string          `json:"set_running"`
+	SetStopped  []string          `json:"set_stopped"`
+	Failed      []failedOperation `json:"failed"`
+}
+
+type failedOperation struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Error  string `json:"error"`
+}
+
+// Build the report file of a run from the pending operations and the results of channel programs
+func newReportFile(report Report, err error, end time.Time) reportFile {
+	file := reportFile{
+		Start:  report.Start,
+		End:    end,
+		Host:   report.Host,
+		DryRun: report.DryRun,
+		Policy: report.Policy,
+		Pools:  []poolReport{},
+		Errors: []string{},
+
+		Deferred: map[int]string{},
+	}
+	for vmid, lock := range report.Deferred {
+		file.Deferred[vmid] = lock
+	}
+	for _, pending := range report.Pools {
+		file.Pools = append(file.Pools, pending.report())
+	}
+	for _, err := range splitErrors(err) {
+		file.Errors = append(file.Errors, err.Error())
+	}
+	return file
+}
+
+func (p *Pending) report() poolReport {
+	report := poolReport{
+		Pool:        p.Pool,
+		Snapshots:   nonNil(p.Snapshots),
+		Destroys:    nonNil(p.Destroys),
+		Created:     sortedKeys(p.results["snapshot"].Succeeded),
+		Destroyed:   sortedKeys(p.results["destroy"].Succeeded),
+		SpacePrunes: nonNil(p.SpacePrunes),
+		Held:        nonNil(p.Held),
+		SetRunning:  sortedKeys(p.results["set running"].Succeeded),
+		SetStopped:  sortedKeys(p.results["set stopped"].Succeeded),
+		Failed:      []failedOperation{},
+	}
+	actions := make([]string, 0, len(p.results))
+	for action := range p.results {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		failed := p.results[action].Failed
+		for _, name := range sortedKeys(failed) {
+			report.Failed = append(report.Failed, failedOperation{
+				Action: action,
+				Name:   name,
+				Error:  syscall.Errno(failed[name]).Error(),
+			})
+		}
+	}
+	return report
+}
+
+// Empty lists are written as [] instead of null
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
+
+// Split errors joined by errors.Join, e.g. errors of pools
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	for unwrapped := err; unwrapped != nil; unwrapped = errors.Unwrap(unwrapped) {
+		if joined, ok := unwrapped.(interface{ Unwrap() []error }); ok {
+			return joined.Unwrap()
+		}
+	}
+	return []error{err}
+}
+
+// Write the report file of a run and remove the oldest report files above the limit
+func saveReport(policy reportPolicy, file reportFile) error {
+	if policy.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(policy.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	// File names sort by the start time
+	name := filepath.Join(policy.dir, reportPrefix+file.Start.UTC().Format("20060102T150405Z")+".json")
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return pruneReports(policy)
+}
+
+// Remove the oldest report files, keeping policy.keep files
+func pruneReports(policy reportPolicy) error {
+	entries, err := os.ReadDir(policy.dir)
+	if err != nil {
+		return fmt.Errorf("failed to prune reports: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, reportPrefix) && strings.HasSuffix(name, ".json") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for len(names) > policy.keep {
+		if err := os.Remove(filepath.Join(policy.dir, names[0])); err != nil {
+			return fmt.Errorf("failed to prune reports: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewReportFile(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	mockExec.Outputs["zfs program -j rpool /dev/stdin rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = []byte(
+		`{"return": {"succeeded": {"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped": 0}, "failed": {"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly": 28}}}`)
+	mockExec.Outputs["zfs hold pve-zfs-snap-keep rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped"] = nil
+	mockExec.Outputs["zfs program -j rpool /dev/stdin stopped rpool/data/subvol-101-disk-0"] = []byte(
+		`{"return": {"succeeded": {"rpool/data/subvol-101-disk-0": 0}, "failed": {}}}`)
+
+	env := runTestEnv(t, "h2")
+	report, err := Run(context.Background(), env, deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	end := env.time.now.Add(time.Second)
+	file := newReportFile(report, err, end)
+
+	expected := reportFile{
+		Start:  env.time.now,
+		End:    end,
+		Host:   "HOST-1",
+		Policy: map[string]int{hourly: 2},
+		Pools: []poolReport{{
+			Pool: "rpool",
+			Snapshots: []string{
+				"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped",
+				"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly",
+			},
+			Destroys:    []string{"rpool/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly"},
+			Created:     []string{"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped"},
+			Destroyed:   []string{},
+			SpacePrunes: []string{},
+			Held:        []string{},
+			SetRunning:  []string{},
+			SetStopped:  []string{"rpool/data/subvol-101-disk-0"},
+			Failed: []failedOperation{{
+				Action: "snapshot",
+				Name:   "rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly",
+				Error:  "no space left on device",
+			}},
+		}},
+		Errors:   []string{},
+		Deferred: map[int]string{},
+	}
+	if !reflect.DeepEqual(file, expected) {
+		t.Errorf("newReportFile() = %+v, want %+v", file, expected)
+	}
+}
+
+func TestNewReportFileErrors(t *testing.T) {
+	err := &PartialError{fmt.Errorf("pool tank: %w", fmt.Errorf("I/O error"))}
+	file := newReportFile(Report{}, err, time.Time{})
+	if !reflect.DeepEqual(file.Errors, []string{"pool tank: I/O error"}) {
+		t.Errorf("Errors = %v", file.Errors)
+	}
+}
+
+func TestSaveReport(t *testing.T) {
+	policy := reportPolicy{dir: filepath.Join(t.TempDir(), "reports"), keep: 2}
+	start := time.Date(2023, 1, 24, 8, 0, 2, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		file := reportFile{Start: start.Add(time.Duration(i) * time.Hour), Host: "HOST-1"}
+		if err := saveReport(policy, file); err != nil {
+			t.Fatalf("saveReport returned error: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(policy.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"pve-zfs-snap-20230124T090002Z.json", "pve-zfs-snap-20230124T100002Z.json"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("report files = %v, want %v", names, expected)
+	}
+
+	data, err := os.ReadFile(filepath.Join(policy.dir, expected[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file reportFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+	if file.Host != "HOST-1" || !file.Start.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("unexpected report %+v", file)
+	}
+}
+
+func TestSaveReportDisabled(t *testing.T) {
+	if err := saveReport(reportPolicy{}, reportFile{}); err != nil {
+		t.Errorf("saveReport returned error: %v", err)
+	}
+}
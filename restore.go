@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Directory of the zvol device links created by udev
+var zvolDevDir = "/dev/zvol"
+
+type restoreOptions struct {
+	vmid     int
+	snapshot string   // snapshot name without the dataset
+	paths    []string // paths of files inside the guest
+	disk     string   // "" - search all disks of the guest
+	target   string   // directory the files are copied to
+}
+
+func (o *restoreOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--vmid' requires a VMID")
+		}
+		o.vmid = vmid
+	case "snapshot":
+		if value == "" || strings.ContainsAny(value, "@/") {
+			return true, fmt.Errorf("option '--snapshot' requires a snapshot name without the dataset")
+		}
+		o.snapshot = value
+	case "path":
+		if value == "" {
+			return true, fmt.Errorf("option '--path' requires a path")
+		}
+		o.paths = append(o.paths, value)
+	case "disk":
+		o.disk = value
+	case "target":
+		o.target = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Copy files out of a snapshot of a guest
+func restoreFileCommand(ctx context.Context, e Exec, args []string) error {
+	options := restoreOptions{target: "."}
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	if options.vmid == 0 || options.snapshot == "" || len(options.paths) == 0 {
+		return &UsageError{fmt.Errorf("restore-file requires --vmid, --snapshot and --path")}
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	return restoreFiles(ctx, e, source, env, options)
+}
+
+// Search the disks of the guest for the paths and copy them to the target directory
+func restoreFiles(ctx context.Context, e Exec, source VMSource, env environment, options restoreOptions) error {
+	_, disks, err := findGuest(ctx, e, source, env, options.vmid)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, pool := range sortedPools(disks) {
+		for _, disk := range disks[pool] {
+			if options.disk == "" || path.Base(disk.name) == options.disk || disk.name == options.disk {
+				names = append(names, disk.name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("guest %d has no disk %s", options.vmid, options.disk)
+	}
+
+	pending := make(map[string]bool)
+	for _, p := range options.paths {
+		pending[p] = true
+	}
+	for _, name := range names {
+		err := exposeSnapshot(ctx, e, name, options.snapshot, env.time.unix, func(root string) error {
+			for _, p := range options.paths {
+				if !pending[p] {
+					continue
+				}
+				src, err := resolveInRoot(root, p)
+				if err != nil {
+					continue
+				}
+				if _, err := command(ctx, e, "cp", "-a", "--", src, options.target); err != nil {
+					return err
+				}
+				fmt.Printf("restored %s from %s@%s to %s\n", p, name, options.snapshot, options.target)
+				delete(pending, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+	}
+	var missing []string
+	for _, p := range options.paths {
+		if pending[p] {
+			missing = append(missing, p)
+		}
+	}
+	return fmt.Errorf("not found in %s: %s", options.snapshot, strings.Join(missing, ", "))
+}
+
+// Most symlinks a path may follow, like MAXSYMLINKS of Linux
+const maxSymlinks = 40
+
+// Resolve a path of the guest under the root of its file system the way the guest would, so that
+// a symlink of the guest, e.g. /etc -> /root/.ssh of the host, never leads out of the root.
+// Symlinks of the intermediate components are followed inside the root, the last component is not
+// followed, cp -a copies it as a symlink.
+func resolveInRoot(root string, p string) (string, error) {
+	var resolved []string
+	pending := strings.Split(p, "/")
+	links := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			// The parent of the root is the root
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		current := filepath.Join(root, filepath.Join(resolved...), component)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return "", err
+		}
+		last := true
+		for _, next := range pending {
+			if next != "" && next != "." {
+				last = false
+			}
+		}
+		if info.Mode()&os.ModeSymlink == 0 || last {
+			resolved = append(resolved, component)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks in %s", p)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
+
+// Make the file systems of a disk snapshot available read-only and call fn for the root of each.
+// The snapshot of a subvol is reachable under .zfs/snapshot, a zvol is cloned temporarily
+// and its partitions are mounted, everything is torn down before returning,
+// even if ctx is canceled meanwhile.
+func exposeSnapshot(ctx context.Context, e Exec, disk string, snapshot string, unix int64, fn func(root string) error) error {
+	teardown := context.WithoutCancel(ctx)
+	if strings.HasPrefix(path.Base(disk), "subvol-") {
+		output, err := command(ctx, e, "zfs", "get", "-H", "-o", "value", "mountpoint", disk)
+		if err != nil {
+			return err
+		}
+		mountpoint := strings.TrimSpace(string(output))
+		if !strings.HasPrefix(mountpoint, "/") {
+			return fmt.Errorf("%s is not mounted", disk)
+		}
+		return fn(filepath.Join(mountpoint, ".zfs", "snapshot", snapshot))
+	}
+
+	// The clone name does not start with a guest disk name, so runs never snapshot it
+	clone := fmt.Sprintf("%s/pve-zfs-snap-restore-%d-%s", path.Dir(disk), unix, path.Base(disk))
+	if _, err := command(ctx, e, "zfs", "clone", "-o", "volmode=full", disk+"@"+snapshot, clone); err != nil {
+		return err
+	}
+	fmt.Printf("cloned %s@%s to %s\n", disk, snapshot, clone)
+	defer func() {
+		if _, err := command(teardown, e, "zfs", "destroy", clone); err != nil {
+			fmt.Printf("failed to destroy %s: %v\n", clone, err)
+		}
+	}()
+	// Wait for udev to create the device links of the clone and its partitions
+	if _, err := command(ctx, e, "udevadm", "settle"); err != nil {
+		return err
+	}
+	devices, err := filepath.Glob(filepath.Join(zvolDevDir, clone+"-part*"))
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		devices = []string{filepath.Join(zvolDevDir, clone)}
+	}
+
+	var errs []error
+	for _, device := range devices {
+		dir, err := os.MkdirTemp("", "pve-zfs-snap-restore-")
+		if err != nil {
+			return err
+		}
+		// Partitions without a file system, e.g. swap, can not be mounted
+		if _, err := command(ctx, e, "mount", "-o", "ro", device, dir); err != nil {
+			fmt.Printf("skipping %s: %v\n", device, err)
+			os.Remove(dir)
+			continue
+		}
+		errs = append(errs, fn(dir))
+		if _, err := command(teardown, e, "umount", dir); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		os.Remove(dir)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreFilesSubvol(t *testing.T) {
+	mountpoint := t.TempDir()
+	snapdir := filepath.Join(mountpoint, ".zfs", "snapshot", "autosnap_2023-01-24_06:00:02_hourly")
+	if err := os.MkdirAll(filepath.Join(snapdir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(snapdir, "etc", "hosts"), []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs["zfs get -H -o value mountpoint rpool/data/subvol-101-disk-0"] = []byte(mountpoint + "\n")
+	mockExec.Outputs["cp -a -- "+filepath.Join(snapdir, "etc", "hosts")+" /root/restore"] = nil
+	mockExec.Stdin = make(map[string][]byte)
+
+	options := restoreOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", paths: []string{"/etc/hosts"}, target: "/root/restore"}
+	if err := restoreFiles(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options); err != nil {
+		t.Fatalf("restoreFiles returned error: %v", err)
+	}
+	if _, ok := mockExec.Stdin["cp -a -- "+filepath.Join(snapdir, "etc", "hosts")+" /root/restore"]; !ok {
+		t.Errorf("the file was not copied")
+	}
+
+	options.paths = []string{"/etc/hosts", "/etc/../../etc/shadow"}
+	err := restoreFiles(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options)
+	if err == nil || !strings.Contains(err.Error(), "not found in autosnap_2023-01-24_06:00:02_hourly: /etc/../../etc/shadow") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestRestoreFilesZvolTeardown(t *testing.T) {
+	original := zvolDevDir
+	zvolDevDir = t.TempDir()
+	t.Cleanup(func() { zvolDevDir = original })
+
+	mockExec := newRunTestExec("rpool")
+	clone := "rpool/data/pve-zfs-snap-restore-1674547202-vm-100-disk-0"
+	mockExec.Outputs["zfs clone -o volmode=full rpool/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly "+clone] = nil
+	mockExec.Outputs["udevadm settle"] = nil
+	mockExec.Outputs["zfs destroy "+clone] = nil
+	mockExec.Stdin = make(map[string][]byte)
+
+	options := restoreOptions{vmid: 100, snapshot: "autosnap_2023-01-24_06:00:02_hourly", paths: []string{"/etc/hosts"}, target: "."}
+	err := restoreFiles(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if _, ok := mockExec.Stdin["zfs destroy "+clone]; !ok {
+		t.Errorf("the temporary clone was not destroyed")
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	host := t.TempDir()
+	if err := os.WriteFile(filepath.Join(host, "secret"), []byte("host\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "hosts"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"cfg":     "/etc",       // absolute symlink of the guest
+		"up":      "../../..",   // climbs above the root
+		"leak":    host,         // a host path, must stay under the root
+		"hosts":   "etc/hosts",  // the last component is not followed
+		"loop":    "loop/x",     // never resolves
+		"etc/rel": "../cfg/.//", // relative to its directory
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path     string
+		resolved string // "" - an error
+	}{
+		{"/etc/hosts", "etc/hosts"},
+		{"/cfg/hosts", "etc/hosts"},
+		{"/up/etc/hosts", "etc/hosts"},
+		{"/etc/rel/hosts", "etc/hosts"},
+		{"/etc/../../etc/hosts", "etc/hosts"},
+		{"/hosts", "hosts"},
+		{"/cfg", "cfg"},
+		{"/leak/secret", ""},
+		{"/loop/x", ""},
+	}
+	for _, test := range tests {
+		got, err := resolveInRoot(root, test.path)
+		if test.resolved == "" {
+			if err == nil {
+				t.Errorf("resolveInRoot(%s) = %s, want an error", test.path, got)
+			}
+			continue
+		}
+		if want := filepath.Join(root, test.resolved); err != nil || got != want {
+			t.Errorf("resolveInRoot(%s) = %s, %v, want %s", test.path, got, err, want)
+		}
+	}
+}
+
+// Cancels the context of the run once udev settled, like a signal in the middle of a restore
+type cancelingExec struct {
+	recordingExec
+	cancel context.CancelFunc
+}
+
+func (c *cancelingExec) Run(ctx context.Context, cmd Cmd) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if cmd.Name == "udevadm" {
+		c.cancel()
+	}
+	return c.recordingExec.Run(ctx, cmd)
+}
+
+func TestExposeSnapshotTeardownAfterCancel(t *testing.T) {
+	original := zvolDevDir
+	zvolDevDir = t.TempDir()
+	t.Cleanup(func() { zvolDevDir = original })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := &cancelingExec{cancel: cancel}
+	err := exposeSnapshot(ctx, e, "rpool/data/vm-100-disk-0", "autosnap_2023-01-24_06:00:02_hourly", 1674547202, func(string) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("exposeSnapshot returned error: %v", err)
+	}
+	destroy := "zfs destroy rpool/data/pve-zfs-snap-restore-1674547202-vm-100-disk-0"
+	if last := e.Commands[len(e.Commands)-1]; last != destroy {
+		t.Errorf("last command = %s, want %s", last, destroy)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type rollbackOptions struct {
+	vmid      int
+	snapshot  string // snapshot name without the dataset
+	safety    bool   // keep a copy of the current state of the disks
+	force     bool   // destroy snapshots newer than the target
+	multiPool bool   // roll back the pools one after another
+}
+
+func (o *rollbackOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--vmid' requires a VMID")
+		}
+		o.vmid = vmid
+	case "snapshot":
+		if value == "" || strings.ContainsAny(value, "@/") {
+			return true, fmt.Errorf("option '--snapshot' requires a snapshot name without the dataset")
+		}
+		o.snapshot = value
+	case "safety-snapshot":
+		o.safety = true
+	case "force":
+		o.force = true
+	case "multi-pool":
+		o.multiPool = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Roll back all disks of a stopped guest to a snapshot
+func rollbackCommand(ctx context.Context, e Exec, args []string) error {
+	var options rollbackOptions
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	if options.vmid == 0 || options.snapshot == "" {
+		return &UsageError{fmt.Errorf("rollback requires --vmid and --snapshot")}
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	return rollbackGuest(ctx, e, source, env, options)
+}
+
+// Disks of a guest by pool
+type guestDisks map[string][]zfs
+
+// Find a guest of the node and its disks on all pools. Received replicas of the same VMID
+// are not disks of the guest, they are skipped like in a run.
+func findGuest(ctx context.Context, e Exec, source VMSource, env environment, vmid int) (VM, guestDisks, error) {
+	vms, err := ListVMs(ctx, source, env.hostname)
+	if err != nil {
+		return VM{}, nil, err
+	}
+	var guest *VM
+	for i := range vms {
+		if vms[i].VMID == vmid {
+			guest = &vms[i]
+		}
+	}
+	if guest == nil {
+		return VM{}, nil, fmt.Errorf("guest %d is not found on node %s", vmid, env.hostname)
+	}
+	configs, err := readGuestConfigs(env.hostname, vms)
+	if err != nil {
+		return VM{}, nil, err
+	}
+	pools, err := ZpoolList(ctx, e)
+	if err != nil {
+		return VM{}, nil, err
+	}
+	disks := make(guestDisks)
+	var replicas []string
+	for _, pool := range pools {
+		allZFS, err := ZFSlist(ctx, e, pool)
+		if err != nil {
+			return VM{}, nil, err
+		}
+		for _, zfs := range markReplicas(filterZfsInVms(allZFS, []int{vmid}), configs) {
+			if zfs.replica != "" {
+				replicas = append(replicas, fmt.Sprintf("%s (%s)", zfs.name, zfs.replica))
+				continue
+			}
+			disks[pool] = append(disks[pool], zfs)
+		}
+	}
+	if len(disks) == 0 && len(replicas) > 0 {
+		return VM{}, nil, fmt.Errorf("guest %d has only received replicas: %s", vmid, strings.Join(replicas, ", "))
+	}
+	if len(disks) == 0 {
+		return VM{}, nil, fmt.Errorf("guest %d has no ZFS disks", vmid)
+	}
+	return *guest, disks, nil
+}
+
+func rollbackGuest(ctx context.Context, e Exec, source VMSource, env environment, options rollbackOptions) error {
+	guest, disks, err := findGuest(ctx, e, source, env, options.vmid)
+	if err != nil {
+		return err
+	}
+	if guest.Status != "stopped" {
+		return fmt.Errorf("guest %d is %s, stop it before the rollback", guest.VMID, guest.Status)
+	}
+	// A channel program runs on one pool, a failure on a later pool can not undo the earlier pools
+	if pools := sortedPools(disks); len(pools) > 1 && !options.multiPool {
+		return fmt.Errorf("guest %d has disks on pools %s, they are rolled back one after another and a failure leaves "+
+			"them at different points in time, use --multi-pool to confirm", guest.VMID, strings.Join(pools, ", "))
+	}
+
+	// Check all disks before changing anything. The keep holds of the newer snapshots
+	// are released before the rollback, the other holds are not ours to release.
+	keepHeld := make(map[string][]string)
+	for _, pool := range sortedPools(disks) {
+		poolSnapshots, err := ZfsListPoolSnapshots(ctx, e, pool)
+		if err != nil {
+			return err
+		}
+		for _, disk := range disks[pool] {
+			newer, err := snapshotsAfter(poolSnapshots[disk.name], disk.name+"@"+options.snapshot)
+			if err != nil {
+				return err
+			}
+			for _, snapshot := range newer {
+				if snapshot.heldByOthers() {
+					return fmt.Errorf("snapshot %s is held, release or unpin it before the rollback", snapshot.name)
+				}
+				if snapshot.hasHold(keepTag) {
+					keepHeld[pool] = append(keepHeld[pool], snapshot.name)
+				}
+			}
+			if len(newer) > 0 && !options.force {
+				return fmt.Errorf("rollback of %s destroys %d newer snapshots, use --force to confirm", disk.name, len(newer))
+			}
+		}
+	}
+
+	var rolledBack []string
+	for _, pool := range sortedPools(disks) {
+		var names []string
+		for _, disk := range disks[pool] {
+			names = append(names, disk.name)
+		}
+		if options.safety {
+			snapshotName := env.namingOf(pool).format(env.time.now, "prerollback")
+			if err := saveCurrentState(ctx, e, pool, names, snapshotName, env.time.now.Format("20060102T150405")); err != nil {
+				return err
+			}
+		}
+		if len(keepHeld[pool]) > 0 {
+			if _, err := command(ctx, e, "zfs", append([]string{"release", keepTag}, keepHeld[pool]...)...); err != nil {
+				return err
+			}
+		}
+		// One channel program per pool, so the disks of a pool never end up at different points in time
+		result, err := program(ctx, e, pool, "lua_rollback", append([]string{options.snapshot}, names...))
+		if err != nil {
+			return err
+		}
+		if len(result.Failed) > 0 {
+			var failed []string
+			for _, name := range sortedKeys(result.Failed) {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, syscall.Errno(result.Failed[name])))
+			}
+			err := fmt.Errorf("rollback of pool %s failed: %s", pool, strings.Join(failed, ", "))
+			if len(rolledBack) > 0 {
+				err = fmt.Errorf("%w, pools %s are already rolled back", err, strings.Join(rolledBack, ", "))
+			}
+			return err
+		}
+		for _, name := range names {
+			fmt.Printf("rolled back %s to %s\n", name, options.snapshot)
+		}
+		rolledBack = append(rolledBack, pool)
+	}
+	return nil
+}
+
+// Get snapshots created after the target, the snapshots are sorted by createtxg
+func snapshotsAfter(snapshots []snapshot, target string) ([]snapshot, error) {
+	for i, snapshot := range snapshots {
+		if snapshot.name == target {
+			return snapshots[i+1:], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s does not exist", target)
+}
+
+// Snapshot the disks and copy the snapshots to new datasets, since the rollback destroys
+// every snapshot newer than the target. The copy of vm-100-disk-0 is vm-100-prerollback-<time>-0,
+// PVE shows it as an unused disk of the guest and it is not snapshotted.
+// A clone can not be used: it keeps its origin snapshot, which the rollback has to destroy,
+// and promoting it moves the target snapshot away from the disk. So the copy is a full one.
+func saveCurrentState(ctx context.Context, e Exec, pool string, names []string, snapshotName string, stamp string) error {
+	var snapshots []string
+	for _, name := range names {
+		snapshots = append(snapshots, name+"@"+snapshotName)
+	}
+	result, err := program(ctx, e, pool, "lua_snapshot", snapshots)
+	if err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		reportFailed("snapshot", result)
+		return fmt.Errorf("failed to create the safety snapshots of pool %s", pool)
+	}
+	for _, name := range names {
+		copyName := path.Join(path.Dir(name), strings.Replace(path.Base(name), "-disk-", "-prerollback-"+stamp+"-", 1))
+		script := fmt.Sprintf("zfs send %s | zfs receive -u %s", shellQuote(name+"@"+snapshotName), shellQuote(copyName))
+		if _, err := command(ctx, e, "bash", "-o", "pipefail", "-c", script); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+		fmt.Printf("saved the current state of %s to %s\n", name, copyName)
+	}
+	return nil
+}
+
+func sortedPools(disks guestDisks) []string {
+	pools := make([]string, 0, len(disks))
+	for pool := range disks {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	return pools
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// Container 101 is stopped and has two hourly snapshots
+func newRollbackTestExec() *MockExec {
+	mockExec := newRunTestExec("rpool")
+	mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t0\t0\t100\t0\n" +
+			"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly\t1674543602\t0\t0\t0\t200\t0\n")
+	mockExec.Outputs["zfs program -j rpool /dev/stdin autosnap_2023-01-24_06:00:02_hourly rpool/data/subvol-101-disk-0"] = []byte(
+		`{"return": {"succeeded": {"rpool/data/subvol-101-disk-0": 0}, "failed": {}}}`)
+	return mockExec
+}
+
+func TestRollbackGuest(t *testing.T) {
+	env := runTestEnv(t)
+	tests := []struct {
+		name    string
+		options rollbackOptions
+		err     string
+	}{
+		{"running guest", rollbackOptions{vmid: 100, snapshot: "autosnap_2023-01-24_06:00:02_hourly"}, "guest 100 is running"},
+		{"unknown guest", rollbackOptions{vmid: 102, snapshot: "autosnap_2023-01-24_06:00:02_hourly"}, "guest 102 is not found"},
+		{"missing snapshot", rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_05:00:02_hourly"}, "does not exist"},
+		{"newer snapshots", rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly"}, "destroys 1 newer snapshots"},
+		{"latest snapshot", rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_07:00:02_hourly"}, ""},
+		{"forced", rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", force: true}, ""},
+	}
+	for _, test := range tests {
+		mockExec := newRollbackTestExec()
+		mockExec.Outputs["zfs program -j rpool /dev/stdin autosnap_2023-01-24_07:00:02_hourly rpool/data/subvol-101-disk-0"] = []byte(
+			`{"return": {"succeeded": {"rpool/data/subvol-101-disk-0": 0}, "failed": {}}}`)
+		err := rollbackGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, test.options)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestRollbackGuestHeld(t *testing.T) {
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t0\t0\t100\t0\n" +
+			"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly\t1674543602\t1\t0\t0\t200\t0\n")
+	mockExec.Outputs["zfs holds -H rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly"] = []byte(
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly\tpve-zfs-snap-pin\tTue Jan 24 07:05 2023\n")
+	options := rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", force: true}
+	err := rollbackGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options)
+	if err == nil || !strings.Contains(err.Error(), "is held") {
+		t.Errorf("expected held snapshot error, got %v", err)
+	}
+}
+
+func TestRollbackGuestKeepHold(t *testing.T) {
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t0\t0\t100\t0\n" +
+			"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly\t1674543602\t1\t0\t0\t200\t0\n")
+	mockExec.Outputs["zfs holds -H rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly"] = []byte(
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly\tpve-zfs-snap-keep\tTue Jan 24 07:00 2023\n")
+	releaseKey := "zfs release pve-zfs-snap-keep rpool/data/subvol-101-disk-0@autosnap_2023-01-24_07:00:02_hourly"
+	mockExec.Outputs[releaseKey] = nil
+	mockExec.Stdin = make(map[string][]byte)
+
+	// The keep hold of the newest hourly snapshot does not block the rollback
+	options := rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", force: true}
+	if err := rollbackGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options); err != nil {
+		t.Fatalf("rollbackGuest returned error: %v", err)
+	}
+	if _, ok := mockExec.Stdin[releaseKey]; !ok {
+		t.Errorf("the keep hold was not released")
+	}
+}
+
+func TestRollbackGuestSafety(t *testing.T) {
+	mockExec := newRollbackTestExec()
+	mockExec.Outputs["zfs program -j rpool /dev/stdin rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_prerollback"] = []byte(
+		`{"return": {"succeeded": {"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_prerollback": 0}, "failed": {}}}`)
+	copyKey := "bash -o pipefail -c zfs send rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_prerollback | " +
+		"zfs receive -u rpool/data/subvol-101-prerollback-20230124T080002-0"
+	mockExec.Outputs[copyKey] = nil
+	mockExec.Stdin = make(map[string][]byte)
+
+	options := rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", force: true, safety: true}
+	if err := rollbackGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options); err != nil {
+		t.Fatalf("rollbackGuest returned error: %v", err)
+	}
+	if _, ok := mockExec.Stdin[copyKey]; !ok {
+		t.Errorf("the current state was not copied")
+	}
+	if _, ok := mockExec.Stdin["zfs program -j rpool /dev/stdin autosnap_2023-01-24_06:00:02_hourly rpool/data/subvol-101-disk-0"]; !ok {
+		t.Errorf("the rollback program was not run")
+	}
+}
+
+func TestRollbackGuestMultiPool(t *testing.T) {
+	mockExec := newRollbackTestExec()
+	for key, output := range runTestOutputs("tank") {
+		mockExec.Outputs[key] = output
+	}
+	mockExec.Outputs["zpool list -H -o name"] = []byte("rpool\ntank\n")
+	mockExec.Outputs[runTestSnapshotsKey+"tank"] = []byte(
+		"tank/data/subvol-101-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t0\t0\t100\t0\n")
+	mockExec.Outputs["zfs program -j tank /dev/stdin autosnap_2023-01-24_06:00:02_hourly tank/data/subvol-101-disk-0"] = []byte(
+		`{"return": {"succeeded": {}, "failed": {"tank/data/subvol-101-disk-0": 16}}}`)
+
+	options := rollbackOptions{vmid: 101, snapshot: "autosnap_2023-01-24_06:00:02_hourly", force: true}
+	err := rollbackGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options)
+	if err == nil || !strings.Contains(err.Error(), "has disks on pools rpool, tank") {
+		t.Errorf("expected multi-pool error, got %v", err)
+	}
+
+	options.multiPool = true
+	err = rollbackGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), options)
+	if err == nil || !strings.Contains(err.Error(), "rollback of pool tank failed") || !strings.Contains(err.Error(), "pools rpool are already rolled back") {
+		t.Errorf("expected failure of tank after rpool, got %v", err)
+	}
+}
+
+func TestFindGuestSkipsReplicas(t *testing.T) {
+	// The disk on tank is a replica received from another site, it is not in the config of the container
+	newReplicaTestDir(t, map[string]string{"lxc/101.conf": "rootfs: local-zfs:subvol-101-disk-0,size=8G\n"})
+	mockExec := newRollbackTestExec()
+	for key, output := range runTestOutputs("tank") {
+		mockExec.Outputs[key] = output
+	}
+	mockExec.Outputs["zpool list -H -o name"] = []byte("rpool\ntank\n")
+
+	_, disks, err := findGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), 101)
+	if err != nil {
+		t.Fatalf("findGuest returned error: %v", err)
+	}
+	if len(disks) != 1 || len(disks["rpool"]) != 1 || disks["rpool"][0].name != "rpool/data/subvol-101-disk-0" {
+		t.Errorf("expected only the disk on rpool, got %v", disks)
+	}
+
+	newReplicaTestDir(t, map[string]string{"lxc/101.conf": "rootfs: tank-zfs:subvol-101-disk-0,size=8G\n"})
+	_, _, err = findGuest(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), 101)
+	if err == nil || !strings.Contains(err.Error(), "has only received replicas") {
+		t.Errorf("expected only replicas error, got %v", err)
+	}
+}
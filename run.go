@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// External dependencies of a run
+type deps struct {
+	exec   Exec
+	source VMSource
+}
+
+// Report of a run
+type Report struct {
+	Start  time.Time
+	Host   string
+	DryRun bool
+	Policy map[string]int // number of snapshots per tier
+	Pools  []*Pending
+	// Locks of the guests deferred to the next run
+	Deferred map[int]string
+}
+
+// Run discovers guests and pools, creates and prunes snapshots and updates label:running.
+// A failure of a pool does not stop the other pools, it is returned as PartialError.
+func Run(ctx context.Context, env environment, d deps) (Report, error) {
+	report := Report{
+		Start:  env.time.now,
+		Host:   env.hostname,
+		DryRun: env.dryRun,
+		Policy: make(map[string]int),
+	}
+	for tier, policy := range env.policy {
+		report.Policy[tier] = policy.count
+	}
+
+	poolList, err := ZpoolList(ctx, d.exec)
+	if err != nil {
+		return report, &DiscoveryError{err}
+	}
+	poolList, missing := env.filter.filterPools(poolList)
+	logMissingPools(missing)
+
+	vms, err := ListVMs(ctx, d.source, env.hostname)
+	if err != nil {
+		return report, &DiscoveryError{err}
+	}
+
+	configs, err := readGuestConfigs(env.hostname, vms)
+	if err != nil {
+		return report, &DiscoveryError{err}
+	}
+	if configs == nil {
+		logUncheckedConfigs(env.hostname)
+	}
+
+	guests := newRunGuests(vms, configs)
+	report.Deferred = guests.deferred
+	vms = guests.active(vms)
+
+	runs := newPoolRuns(poolList, env.poolTimeout)
+
+	forEachPool(ctx, runs, env.parallel, func(ctx context.Context, run *poolRun) error {
+		pending, err := planPool(ctx, d.exec, run.pool, env, configs, guests)
+		run.pending = pending
+		return err
+	})
+
+	// Snapshots of all pools are created between the hooks while the guests are frozen
+	pendings := plannedPendings(runs)
+	if env.dryRun {
+		printGuestPlan(vms, pendings, env.hooks, env.freeze)
+	} else {
+		err = withHooks(ctx, d.exec, vms, pendings, env.hooks, func() error {
+			frozen := freezeVMIDs(vms, pendings, env.freeze)
+			return withFrozen(ctx, d.exec, frozen, env.freeze.timeout, func() error {
+				forEachPool(ctx, runs, env.parallel, func(ctx context.Context, run *poolRun) error {
+					return run.pending.CreateSnapshots(ctx, d.exec)
+				})
+				return nil
+			})
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	forEachPool(ctx, runs, env.parallel, func(ctx context.Context, run *poolRun) error {
+		return run.pending.Run(ctx, d.exec)
+	})
+	report.Pools = pendings
+	if err := poolErrors(runs); err != nil {
+		return report, &PartialError{err}
+	}
+	return report, nil
+}
+
+// Plan the operations of a pool
+func planPool(ctx context.Context, e Exec, pool string, env environment, configs guestConfigs, guests runGuests) (*Pending, error) {
+	pending := &Pending{Pool: pool, Hosname: env.hostname, Guard: env.guard, DryRun: env.dryRun}
+	naming := env.namingOf(pool)
+
+	allZFS, err := ZFSlist(ctx, e, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	// Selected datasets without received replicas
+	markedZFS := markReplicas(env.filter.filterDatasets(allZFS), configs)
+	logReplicas(markedZFS)
+	selectedZFS := filterReplicas(markedZFS)
+
+	// All datasets related to VMs
+	allZFS = filterZfsInVms(selectedZFS, guests.all)
+
+	// Datasets related to running VMs
+	runningZFS := filterZfsInVms(allZFS, guests.running)
+
+	pendingStopZFS := getPendingStopZFS(allZFS, runningZFS, env.hostname)
+	pendingStartZFS := getPendingStartZFS(allZFS, runningZFS, env.hostname)
+
+	processPendingsZFS(pending, pendingStopZFS, pendingStartZFS, env)
+
+	// Filter nosnap datasets
+	runningZFS = filterNoSnap(runningZFS)
+
+	poolSnapshots, err := ZfsListPoolSnapshots(ctx, e, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := 0
+	for _, zfs := range runningZFS {
+		if zfs.freeze {
+			pending.freezeLabeled = append(pending.freezeLabeled, vmidOf(zfs.name))
+		}
+
+		snapshots := poolSnapshots[zfs.name]
+		pending.countExisting(zfs.name, len(snapshots))
+
+		// Snapshots grouped by types and filtered by pattern
+		groupedSnapshots := splitSnapshots(snapshots, naming)
+		legacy += naming.countLegacy(snapshots)
+
+		// A tier is unchanged if nothing was written since its own newest snapshot,
+		// the written property of the dataset counts only since the newest snapshot of any tier
+		for _, tier := range tiers {
+			tierZFS := zfs
+			if tierSnapshots := groupedSnapshots[tier]; env.policy[tier].skipUnchanged && len(tierSnapshots) > 0 {
+				tierZFS.written = writtenSince(snapshots, tierSnapshots[len(tierSnapshots)-1], zfs)
+			}
+			processSnapshots(pending, groupedSnapshots[tier], tierZFS, env.policy[tier], env.time.unix, naming.format(env.time.now, tier))
+		}
+
+		for _, tier := range spacePriority {
+			pending.addSpaceCandidate(tier, groupedSnapshots[tier])
+		}
+	}
+
+	if legacy > 0 {
+		fmt.Printf("pool %s has %d snapshots of the default autosnap format which are never pruned, add sanoid to --naming to age them out\n", pool, legacy)
+	}
+
+	// Templates never run, their snapshots follow the template policy
+	if env.templatePolicy != nil && len(guests.templates) > 0 {
+		for _, zfs := range filterNoSnap(filterZfsInVms(selectedZFS, guests.templates)) {
+			snapshots := poolSnapshots[zfs.name]
+			pending.countExisting(zfs.name, len(snapshots))
+			groupedSnapshots := splitSnapshots(snapshots, naming)
+			for _, tier := range tiers {
+				processSnapshots(pending, groupedSnapshots[tier], zfs, env.templatePolicy[tier], env.time.unix, naming.format(env.time.now, tier))
+			}
+		}
+	}
+
+	if env.space.high > 0 {
+		space, err := ZpoolSpace(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		pending.pruneForSpace(ctx, e, space, env.space)
+	}
+	return pending, nil
+}
+
+// Get the bytes written to a dataset since one of its snapshots: written of the snapshots after it
+// in createtxg order and of the dataset. Blocks rewritten in between are counted more than once,
+// so a tier is never skipped for less data than was written.
+func writtenSince(all []snapshot, since snapshot, dataset zfs) int64 {
+	return writtenBetween(all, since, all[len(all)-1]) + dataset.written
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const runTestVMs = `[
+	{"id": "qemu/100", "name": "web", "node": "HOST-1", "status": "running", "type": "qemu", "vmid": 100},
+	{"id": "lxc/101", "name": "db", "node": "HOST-1", "status": "stopped", "type": "lxc", "vmid": 101},
+	{"id": "qemu/200", "name": "other", "node": "HOST-2", "status": "running", "type": "qemu", "vmid": 200}
+]`
+
+const runTestSnapshotsKey = "zfs list -H -p -o name,creation,userrefs,used,written,createtxg,referenced -s createtxg -t snapshot -r "
+
+func runTestEnv(t *testing.T, args ...string) environment {
+	env, err := getEnvironment(append([]string{"pve-zfs-snap", "--node=HOST-1", "--time-zone=UTC"}, args...))
+	if err != nil {
+		t.Fatalf("getEnvironment returned error: %v", err)
+	}
+	env.time.now = time.Date(2023, 1, 24, 8, 0, 2, 0, time.UTC)
+	env.time.unix = env.time.now.Unix()
+	return env
+}
+
+// Outputs of a node with one pool: VM 100 is running, container 101 was stopped since the last run
+func runTestOutputs(pool string) map[string][]byte {
+	return map[string][]byte{
+		"zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r " + pool: []byte(
+			"NAME                               LABEL:NOSNAP  LABEL:RUNNING  WRITTEN  LABEL:SNAP-FREEZE\n" +
+				pool + "                              -             -              0        -\n" +
+				pool + "/data/vm-100-disk-0           -             HOST-1         4096     -\n" +
+				pool + "/data/subvol-101-disk-0       -             HOST-1         0        -\n" +
+				pool + "/data/vm-200-disk-0           -             HOST-2         0        -\n"),
+		runTestSnapshotsKey + pool: []byte(
+			pool + "/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t0\t0\t100\t0\n" +
+				pool + "/data/vm-100-disk-0@autosnap_2023-01-24_07:00:02_hourly\t1674543602\t0\t0\t0\t200\t0\n"),
+		"zfs program -j " + pool + " /dev/stdin " + pool + "/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped " + pool + "/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly": []byte(
+			`{"return": {"succeeded": {}, "failed": {}}}`),
+		"zfs hold pve-zfs-snap-keep " + pool + "/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped " + pool + "/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly": nil,
+		"zfs program -j " + pool + " /dev/stdin " + pool + "/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly": []byte(
+			`{"return": {"succeeded": {}, "failed": {}, "held": {}}}`),
+		"zfs program -j " + pool + " /dev/stdin stopped " + pool + "/data/subvol-101-disk-0": []byte(
+			`{"return": {"succeeded": {}, "failed": {}}}`),
+	}
+}
+
+func newRunTestExec(pools ...string) *MockExec {
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			"pvesh get /cluster/resources --type vm --output-format json": []byte(runTestVMs),
+		},
+		Errors: map[string]error{},
+	}
+	var zpoolList string
+	for _, pool := range pools {
+		zpoolList += pool + "\n"
+		for key, output := range runTestOutputs(pool) {
+			mockExec.Outputs[key] = output
+		}
+	}
+	mockExec.Outputs["zpool list -H -o name"] = []byte(zpoolList)
+	return mockExec
+}
+
+func TestRun(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	report, err := Run(context.Background(), runTestEnv(t, "h2"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(report.Pools) != 1 {
+		t.Fatalf("expected 1 pool in the report, got %d", len(report.Pools))
+	}
+	pending := report.Pools[0]
+	expectedSnapshots := []string{
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped",
+		"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly",
+	}
+	if !reflect.DeepEqual(pending.Snapshots, expectedSnapshots) {
+		t.Errorf("Snapshots = %v, want %v", pending.Snapshots, expectedSnapshots)
+	}
+	expectedDestroys := []string{"rpool/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly"}
+	if !reflect.DeepEqual(pending.Destroys, expectedDestroys) {
+		t.Errorf("Destroys = %v, want %v", pending.Destroys, expectedDestroys)
+	}
+	if !reflect.DeepEqual(pending.SetStopped, []string{"rpool/data/subvol-101-disk-0"}) {
+		t.Errorf("SetStopped = %v", pending.SetStopped)
+	}
+}
+
+func TestRunPoolFilter(t *testing.T) {
+	mockExec := newRunTestExec("rpool", "tank")
+	// Listing the datasets of tank fails, so tank must not be touched at all
+	mockExec.Errors["zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r tank"] = fmt.Errorf("excluded")
+	report, err := Run(context.Background(), runTestEnv(t, "h2", "--exclude-pool=tank"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(report.Pools) != 1 || report.Pools[0].Pool != "rpool" {
+		t.Errorf("expected only rpool to be processed, got %+v", report.Pools)
+	}
+}
+
+func TestRunDatasetFilter(t *testing.T) {
+	for _, args := range [][]string{
+		{"h2", "--exclude-dataset=rpool/data/subvol-*"},
+		{"h2", "--include-dataset=rpool/data/vm-*"},
+	} {
+		mockExec := newRunTestExec("rpool")
+		mockExec.Outputs["zfs program -j rpool /dev/stdin rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = []byte(
+			`{"return": {"succeeded": {}, "failed": {}}}`)
+		mockExec.Outputs["zfs hold pve-zfs-snap-keep rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = nil
+		report, err := Run(context.Background(), runTestEnv(t, args...), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+		if err != nil {
+			t.Fatalf("Run(%v) returned error: %v", args, err)
+		}
+		pending := report.Pools[0]
+		expectedSnapshots := []string{"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"}
+		if !reflect.DeepEqual(pending.Snapshots, expectedSnapshots) {
+			t.Errorf("Run(%v): Snapshots = %v, want %v", args, pending.Snapshots, expectedSnapshots)
+		}
+		if len(pending.SetStopped) != 0 {
+			t.Errorf("Run(%v): SetStopped = %v, want none", args, pending.SetStopped)
+		}
+	}
+}
+
+func TestRunSkipsReplicas(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	mockExec.Outputs["zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r rpool"] = []byte(
+		"NAME                          LABEL:NOSNAP  LABEL:RUNNING  WRITTEN  LABEL:SNAP-FREEZE  RDONLY  RECEIVE_RESUME_TOKEN\n" +
+			"rpool                         -             -              0        -                  off     -\n" +
+			"rpool/data/vm-100-disk-0      -             HOST-1         4096     -                  on      -\n" +
+			"rpool/data/subvol-101-disk-0  -             HOST-1         0        -                  off     1-e5d4b2a4c-c0-789c\n")
+	readonlyKey := "zfs get -H -o name,source -t filesystem,volume -r readonly rpool"
+	mockExec.Outputs[readonlyKey] = []byte("rpool\tdefault\nrpool/data/vm-100-disk-0\treceived\nrpool/data/subvol-101-disk-0\tdefault\n")
+	report, err := Run(context.Background(), runTestEnv(t, "h2"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	pending := report.Pools[0]
+	if len(pending.Snapshots) != 0 || len(pending.Destroys) != 0 || len(pending.SetStopped) != 0 {
+		t.Errorf("expected replicas to be skipped, got %+v", pending)
+	}
+
+	// readonly=on set locally is not a replica
+	mockExec.Outputs[readonlyKey] = []byte("rpool\tdefault\nrpool/data/vm-100-disk-0\tlocal\nrpool/data/subvol-101-disk-0\tdefault\n")
+	mockExec.Outputs["zfs program -j rpool /dev/stdin rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = []byte(
+		`{"return": {"succeeded": {}, "failed": {}}}`)
+	mockExec.Outputs["zfs hold pve-zfs-snap-keep rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = nil
+	report, err = Run(context.Background(), runTestEnv(t, "h2"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	expectedSnapshots := []string{"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"}
+	if pending := report.Pools[0]; !reflect.DeepEqual(pending.Snapshots, expectedSnapshots) {
+		t.Errorf("Snapshots = %v, want %v", pending.Snapshots, expectedSnapshots)
+	}
+}
+
+func TestRunSkipsDisksWithoutGuestConfig(t *testing.T) {
+	// Container 101 has no config on the node, its disk is a replica of another site
+	newReplicaTestDir(t, map[string]string{"qemu-server/100.conf": "scsi0: local-zfs:vm-100-disk-0,size=32G\n"})
+	mockExec := newRunTestExec("rpool")
+	mockExec.Outputs["zfs program -j rpool /dev/stdin rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = []byte(
+		`{"return": {"succeeded": {}, "failed": {}}}`)
+	mockExec.Outputs["zfs hold pve-zfs-snap-keep rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"] = nil
+	report, err := Run(context.Background(), runTestEnv(t, "h2"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	pending := report.Pools[0]
+	expectedSnapshots := []string{"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly"}
+	if !reflect.DeepEqual(pending.Snapshots, expectedSnapshots) {
+		t.Errorf("Snapshots = %v, want %v", pending.Snapshots, expectedSnapshots)
+	}
+	if len(pending.SetStopped) != 0 {
+		t.Errorf("SetStopped = %v, want none", pending.SetStopped)
+	}
+}
+
+func TestRunDefersLockedGuests(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	mockExec.Outputs["pvesh get /cluster/resources --type vm --output-format json"] = []byte(`[
+	{"id": "qemu/100", "name": "web", "node": "HOST-1", "status": "running", "type": "qemu", "vmid": 100, "lock": "backup"},
+	{"id": "lxc/101", "name": "db", "node": "HOST-1", "status": "stopped", "type": "lxc", "vmid": 101}
+]`)
+	// The lock of the container is only in its config
+	newReplicaTestDir(t, map[string]string{
+		"qemu-server/100.conf": "scsi0: local-zfs:vm-100-disk-0,size=32G\n",
+		"lxc/101.conf":         "lock: migrate\nrootfs: local-zfs:subvol-101-disk-0,size=8G\n",
+	})
+	report, err := Run(context.Background(), runTestEnv(t, "h2", "--dry-run"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	pending := report.Pools[0]
+	if len(pending.Snapshots) != 0 || len(pending.Destroys) != 0 || len(pending.SetStopped) != 0 {
+		t.Errorf("expected locked guests to be deferred, got %+v", pending)
+	}
+	if expected := map[int]string{100: "backup", 101: "migrate"}; !reflect.DeepEqual(report.Deferred, expected) {
+		t.Errorf("Deferred = %v, want %v", report.Deferred, expected)
+	}
+}
+
+func TestRunTemplatePolicy(t *testing.T) {
+	newTemplateExec := func() *MockExec {
+		mockExec := newRunTestExec("rpool")
+		mockExec.Outputs["pvesh get /cluster/resources --type vm --output-format json"] = []byte(`[
+	{"id": "qemu/102", "name": "tpl", "node": "HOST-1", "status": "stopped", "template": 1, "type": "qemu", "vmid": 102}
+]`)
+		mockExec.Outputs["zfs list -p -o name,label:nosnap,label:running,written,label:snap-freeze,readonly,receive_resume_token,label:role -r rpool"] = []byte(
+			"NAME                      LABEL:NOSNAP  LABEL:RUNNING  WRITTEN  LABEL:SNAP-FREEZE\n" +
+				"rpool                     -             -              0        -\n" +
+				"rpool/data/base-102-disk-0  -             HOST-1         0        -\n")
+		mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+			"rpool/data/base-102-disk-0@__base__\t1674000000\t0\t0\t0\t50\t0\n")
+		return mockExec
+	}
+
+	// By default templates are left alone, label:running is not flipped either
+	mockExec := newTemplateExec()
+	report, err := Run(context.Background(), runTestEnv(t, "h2", "--dry-run"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if pending := report.Pools[0]; len(pending.Snapshots) != 0 || len(pending.SetStopped) != 0 {
+		t.Errorf("expected the template to be skipped, got %+v", pending)
+	}
+
+	mockExec = newTemplateExec()
+	report, err = Run(context.Background(), runTestEnv(t, "h2", "--template-policy=m1", "--dry-run"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	pending := report.Pools[0]
+	expectedSnapshots := []string{"rpool/data/base-102-disk-0@autosnap_2023-01-24_08:00:02_monthly"}
+	if !reflect.DeepEqual(pending.Snapshots, expectedSnapshots) || len(pending.Destroys) != 0 || len(pending.SetStopped) != 0 {
+		t.Errorf("expected a monthly snapshot of the template, got %+v", pending)
+	}
+}
+
+func TestRunSkipUnchangedPerTier(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	// Only 4096 bytes of the dataset were written since the frequently snapshot,
+	// but 1M more since the newest hourly one
+	mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+		"rpool/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t0\t0\t100\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-24_07:00:02_hourly\t1674543602\t0\t0\t0\t200\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-24_07:45:02_frequently\t1674546302\t0\t0\t1048576\t300\t0\n")
+	report, err := Run(context.Background(), runTestEnv(t, "f1", "h2", "--skip-unchanged=f4096,h4096", "--dry-run"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	expected := []string{
+		"rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped",
+		"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly",
+	}
+	if snapshots := report.Pools[0].Snapshots; !reflect.DeepEqual(snapshots, expected) {
+		t.Errorf("Snapshots = %v, want %v", snapshots, expected)
+	}
+}
+
+func TestRunDiscoveryError(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	mockExec.Errors["zpool list -H -o name"] = fmt.Errorf("no pools")
+	_, err := Run(context.Background(), runTestEnv(t, "h2"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if exitCode(err) != exitDiscovery {
+		t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitDiscovery)
+	}
+}
+
+func TestRunPartialFailure(t *testing.T) {
+	mockExec := newRunTestExec("rpool", "tank")
+	mockExec.Errors[runTestSnapshotsKey+"tank"] = fmt.Errorf("I/O error")
+	report, err := Run(context.Background(), runTestEnv(t, "h2"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if exitCode(err) != exitPartialFailure {
+		t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitPartialFailure)
+	}
+	if len(report.Pools) != 1 || report.Pools[0].Pool != "rpool" {
+		t.Errorf("expected rpool to be processed, got %+v", report.Pools)
+	}
+}
+
+func TestRunDestroyRefused(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	// h0 destroys both hourly snapshots of the disk
+	mockExec.Outputs["zfs program -j rpool /dev/stdin rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped"] = []byte(
+		`{"return": {"succeeded": {}, "failed": {}}}`)
+	mockExec.Outputs["zfs hold pve-zfs-snap-keep rpool/data/subvol-101-disk-0@autosnap_2023-01-24_08:00:02_stopped"] = nil
+	_, err := Run(context.Background(), runTestEnv(t, "h0"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if exitCode(err) != exitDestroyRefused {
+		t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitDestroyRefused)
+	}
+}
+
+func TestRunSmallPolicyRotation(t *testing.T) {
+	// d1 m1 y1 replaces every existing snapshot of the disk, one per tier is a normal rotation
+	mockExec := newRunTestExec("rpool")
+	mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+		"rpool/data/vm-100-disk-0@autosnap_2022-01-20_08:00:02_yearly\t1642665602\t0\t0\t0\t10\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2022-12-20_08:00:02_monthly\t1671523202\t0\t0\t0\t20\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-23_08:00:02_daily\t1674460802\t0\t0\t0\t30\t0\n")
+	report, err := Run(context.Background(), runTestEnv(t, "d1", "m1", "y1", "--dry-run"), deps{exec: mockExec, source: PveshSource{Exec: mockExec}})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	expected := []string{
+		"rpool/data/vm-100-disk-0@autosnap_2022-01-20_08:00:02_yearly",
+		"rpool/data/vm-100-disk-0@autosnap_2022-12-20_08:00:02_monthly",
+		"rpool/data/vm-100-disk-0@autosnap_2023-01-23_08:00:02_daily",
+	}
+	if destroys := report.Pools[0].Destroys; !reflect.DeepEqual(destroys, expected) {
+		t.Errorf("Destroys = %v, want %v", destroys, expected)
+	}
+}
+
+func TestExitCodeUsage(t *testing.T) {
+	_, err := getEnvironment([]string{"pve-zfs-snap", "x1"})
+	if exitCode(err) != exitUsage {
+		t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitUsage)
+	}
+	_, err = runSubcommand(context.Background(), &MockExec{}, []string{"pve-zfs-snap", "pin", "rpool/data"})
+	if exitCode(err) != exitUsage {
+		t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitUsage)
+	}
+}
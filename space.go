@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tiers in the order they are pruned when a pool runs out of space
+var spacePriority = []string{frequently, hourly, daily, monthly, yearly}
+
+type spacePolicy struct {
+	high int            // percent of pool capacity which starts pruning, 0 - disabled
+	low  int            // percent of pool capacity to prune down to
+	min  map[string]int // number of snapshots per tier which are never pruned for space
+}
+
+// Snapshots of a dataset tier which may be pruned for space
+type spaceCandidate struct {
+	tier      string
+	snapshots []snapshot
+}
+
+// Remember a dataset tier as a candidate for pruning for space
+func (p *Pending) addSpaceCandidate(tier string, snapshots []snapshot) {
+	if len(snapshots) > 0 {
+		p.spaceCandidates = append(p.spaceCandidates, spaceCandidate{tier: tier, snapshots: snapshots})
+	}
+}
+
+// Destroy the oldest snapshots of the lowest tiers until the pool is below the low watermark.
+// The freed space is estimated with zfs destroy -nvp for all destroys of a dataset together,
+// since destroying adjacent snapshots frees the blocks they share, which used does not count.
+// Space prunes are exempt from the destroy guard, they are bounded by the watermarks and the tier minimums.
+func (p *Pending) pruneForSpace(ctx context.Context, e Exec, space poolSpace, policy spacePolicy) {
+	if policy.high == 0 || space.capacity < policy.high {
+		return
+	}
+	destroys := make(map[string]bool)
+	planned := make(map[string][]string) // destroys by dataset
+	for _, name := range p.Destroys {
+		destroys[name] = true
+		dataset, _, _ := strings.Cut(name, "@")
+		planned[dataset] = append(planned[dataset], name)
+	}
+	allocated := space.size - space.free
+	target := space.size * int64(policy.low) / 100
+	used := make(map[string]int64)
+	for _, candidate := range p.spaceCandidates {
+		for _, snapshot := range candidate.snapshots {
+			used[snapshot.name] = snapshot.used
+		}
+	}
+	reclaim := make(map[string]int64) // estimated space freed by the destroys of a dataset
+	var freed int64
+	for _, candidate := range p.spaceCandidates {
+		dataset, _, _ := strings.Cut(candidate.snapshots[0].name, "@")
+		if _, ok := reclaim[dataset]; ok || len(planned[dataset]) == 0 {
+			continue
+		}
+		reclaim[dataset] = estimateReclaim(ctx, e, planned[dataset], used)
+		freed += reclaim[dataset]
+	}
+	fmt.Printf("pool %s is at %d%% capacity (high watermark %d%%), pruning down to %d%%\n",
+		p.Pool, space.capacity, policy.high, policy.low)
+
+	held := 0
+	for _, tier := range spacePriority {
+		var prunable []snapshot
+		for _, candidate := range p.spaceCandidates {
+			if candidate.tier != tier {
+				continue
+			}
+			var survivors []snapshot
+			for _, snapshot := range candidate.snapshots {
+				if !destroys[snapshot.name] {
+					survivors = append(survivors, snapshot)
+				}
+			}
+			keep := policy.min[tier]
+			if keep < 1 {
+				keep = 1
+			}
+			if len(survivors) <= keep {
+				continue
+			}
+			for _, snapshot := range survivors[:len(survivors)-keep] {
+				if snapshot.userrefs == 0 {
+					prunable = append(prunable, snapshot)
+				} else {
+					held++
+				}
+			}
+		}
+		sort.SliceStable(prunable, func(i, j int) bool {
+			return prunable[i].creation < prunable[j].creation
+		})
+		for _, snapshot := range prunable {
+			if allocated-freed <= target {
+				return
+			}
+			dataset, _, _ := strings.Cut(snapshot.name, "@")
+			planned[dataset] = append(planned[dataset], snapshot.name)
+			estimate := estimateReclaim(ctx, e, planned[dataset], used)
+			fmt.Printf("pool %s: destroying %s to free space (tier %s, ~%d bytes)\n",
+				p.Pool, snapshot.name, tier, estimate-reclaim[dataset])
+			p.Destroys = append(p.Destroys, snapshot.name)
+			p.SpacePrunes = append(p.SpacePrunes, snapshot.name)
+			freed += estimate - reclaim[dataset]
+			reclaim[dataset] = estimate
+		}
+	}
+	if allocated-freed > target {
+		fmt.Printf("pool %s: can not reach %d%% capacity without violating the tier minimums", p.Pool, policy.low)
+		if held > 0 {
+			fmt.Printf(", %d held snapshots are not pruned", held)
+		}
+		fmt.Println()
+	}
+}
+
+// Estimate the space freed by destroying snapshots of one dataset together.
+// If zfs destroy -nvp fails, the sum of the used property of the snapshots is the fallback.
+func estimateReclaim(ctx context.Context, e Exec, names []string, used map[string]int64) int64 {
+	dataset, _, _ := strings.Cut(names[0], "@")
+	var short []string
+	for _, name := range names {
+		_, snapshotName, _ := strings.Cut(name, "@")
+		short = append(short, snapshotName)
+	}
+	output, err := command(ctx, e, "zfs", "destroy", "-nvp", dataset+"@"+strings.Join(short, ","))
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if value, ok := strings.CutPrefix(line, "reclaim\t"); ok {
+				if reclaim, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+					return reclaim
+				}
+			}
+		}
+	}
+	fmt.Printf("can not estimate the space freed by destroying %s, using used: %v\n", strings.Join(names, ", "), err)
+	var sum int64
+	for _, name := range names {
+		sum += used[name]
+	}
+	return sum
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newSpaceTestPending() Pending {
+	pending := Pending{Pool: "rpool", Destroys: []string{"vm-100-disk-1@f1"}}
+	pending.addSpaceCandidate(frequently, []snapshot{
+		{name: "vm-100-disk-1@f1", creation: 100, used: 10},
+		{name: "vm-100-disk-1@f2", creation: 200, used: 10},
+		{name: "vm-100-disk-1@f3", creation: 300, used: 10},
+		{name: "vm-100-disk-1@f4", creation: 400, used: 10},
+	})
+	pending.addSpaceCandidate(hourly, []snapshot{
+		{name: "vm-100-disk-1@h1", creation: 50, used: 30},
+		{name: "vm-100-disk-1@h2", creation: 150, used: 30, userrefs: 1},
+		{name: "vm-100-disk-1@h3", creation: 250, used: 30},
+		{name: "vm-100-disk-1@h4", creation: 350, used: 30},
+	})
+	return pending
+}
+
+func TestPruneForSpace(t *testing.T) {
+	pending := newSpaceTestPending()
+	policy := spacePolicy{high: 90, low: 50, min: map[string]int{frequently: 2}}
+	mockExec := &MockExec{Outputs: map[string][]byte{
+		"zfs destroy -nvp vm-100-disk-1@f1":       []byte("destroy\tvm-100-disk-1@f1\nreclaim\t10\n"),
+		"zfs destroy -nvp vm-100-disk-1@f1,f2":    []byte("destroy\tvm-100-disk-1@f1\ndestroy\tvm-100-disk-1@f2\nreclaim\t25\n"),
+		"zfs destroy -nvp vm-100-disk-1@f1,f2,h1": []byte("reclaim\t55\n"),
+	}}
+
+	// Below the high watermark nothing happens
+	pending.pruneForSpace(context.Background(), mockExec, poolSpace{size: 100, free: 20, capacity: 80}, policy)
+	if len(pending.SpacePrunes) != 0 {
+		t.Fatalf("unexpected prunes: %v", pending.SpacePrunes)
+	}
+
+	// 95 allocated, 10 already freed by f1, frequently keeps 2, h2 is held
+	pending.pruneForSpace(context.Background(), mockExec, poolSpace{size: 100, free: 5, capacity: 95}, policy)
+	expected := []string{"vm-100-disk-1@f2", "vm-100-disk-1@h1"}
+	if !reflect.DeepEqual(pending.SpacePrunes, expected) {
+		t.Errorf("SpacePrunes = %v, want %v", pending.SpacePrunes, expected)
+	}
+	expectedDestroys := append([]string{"vm-100-disk-1@f1"}, expected...)
+	if !reflect.DeepEqual(pending.Destroys, expectedDestroys) {
+		t.Errorf("Destroys = %v, want %v", pending.Destroys, expectedDestroys)
+	}
+}
+
+func TestPruneForSpaceSharedBlocks(t *testing.T) {
+	// f1 and f2 share blocks: together they free more than the sum of their used, h1 is not needed
+	pending := newSpaceTestPending()
+	policy := spacePolicy{high: 90, low: 50, min: map[string]int{frequently: 2}}
+	mockExec := &MockExec{Outputs: map[string][]byte{
+		"zfs destroy -nvp vm-100-disk-1@f1":    []byte("reclaim\t10\n"),
+		"zfs destroy -nvp vm-100-disk-1@f1,f2": []byte("reclaim\t45\n"),
+	}}
+	pending.pruneForSpace(context.Background(), mockExec, poolSpace{size: 100, free: 5, capacity: 95}, policy)
+	if expected := []string{"vm-100-disk-1@f2"}; !reflect.DeepEqual(pending.SpacePrunes, expected) {
+		t.Errorf("SpacePrunes = %v, want %v", pending.SpacePrunes, expected)
+	}
+}
+
+func TestPruneForSpaceEstimateFallback(t *testing.T) {
+	// Without an estimate the used property is summed
+	pending := newSpaceTestPending()
+	policy := spacePolicy{high: 90, low: 50, min: map[string]int{frequently: 2}}
+	mockExec := &MockExec{Errors: map[string]error{
+		"zfs destroy -nvp vm-100-disk-1@f1":          errors.New("failed"),
+		"zfs destroy -nvp vm-100-disk-1@f1,f2":       errors.New("failed"),
+		"zfs destroy -nvp vm-100-disk-1@f1,f2,h1":    errors.New("failed"),
+		"zfs destroy -nvp vm-100-disk-1@f1,f2,h1,h3": errors.New("failed"),
+	}}
+	pending.pruneForSpace(context.Background(), mockExec, poolSpace{size: 100, free: 5, capacity: 95}, policy)
+	if expected := []string{"vm-100-disk-1@f2", "vm-100-disk-1@h1"}; !reflect.DeepEqual(pending.SpacePrunes, expected) {
+		t.Errorf("SpacePrunes = %v, want %v", pending.SpacePrunes, expected)
+	}
+}
+
+func TestSpacePrunesSkipGuard(t *testing.T) {
+	pending := Pending{
+		Pool:        "rpool",
+		Guard:       destroyGuard{maxPercent: 50},
+		Existing:    map[string]int{"rpool/vm-100-disk-1": 4},
+		Destroys:    []string{"rpool/vm-100-disk-1@f1", "rpool/vm-100-disk-1@f2", "rpool/vm-100-disk-1@f3"},
+		SpacePrunes: []string{"rpool/vm-100-disk-1@f2", "rpool/vm-100-disk-1@f3"},
+	}
+	if err := pending.checkDestroys(); err != nil {
+		t.Errorf("checkDestroys() = %v, want space prunes to be exempt", err)
+	}
+	pending.SpacePrunes = nil
+	if err := pending.checkDestroys(); err == nil {
+		t.Errorf("checkDestroys() accepted 3 of 4 snapshots")
+	}
+}
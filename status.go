@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Health verdicts of a guest
+const (
+	statusOK          = "OK"
+	statusStale       = "STALE"       // the newest snapshot of a tier is overdue
+	statusUnprotected = "UNPROTECTED" // a disk has no snapshots or is excluded with nosnap
+	statusReplica     = "REPLICA"     // all disks are received replicas, the sending side snapshots them
+	statusDeferred    = "DEFERRED"    // the guest is locked, the next run defers it
+	statusTemplate    = "TEMPLATE"    // a template without --template-policy, runs do not snapshot it
+)
+
+type statusOptions struct {
+	vmid   int // 0 - all guests
+	output string
+}
+
+// Protection state of a guest
+type guestStatus struct {
+	VMID     int          `json:"vmid"`
+	Name     string       `json:"name"`
+	Node     string       `json:"node"`
+	Status   string       `json:"status"`
+	Lock     string       `json:"lock,omitempty"` // the next run defers a locked guest
+	Template bool         `json:"template,omitempty"`
+	Disks    []diskStatus `json:"disks"`
+	Verdict  string       `json:"verdict"`
+	Reasons  []string     `json:"reasons"`
+}
+
+type diskStatus struct {
+	Disk    string       `json:"disk"`
+	Running string       `json:"running"` // value of label:running
+	NoSnap  bool         `json:"nosnap"`
+	Replica string       `json:"replica,omitempty"` // why the disk is a received replica, runs skip it
+	Pending string       `json:"pending"`           // what the next run does with label:running
+	Tiers   []tierStatus `json:"tiers"`
+}
+
+type tierStatus struct {
+	Tier   string `json:"tier"`
+	Count  int    `json:"count"`
+	Policy int    `json:"policy"`
+	Newest string `json:"newest"`
+	Age    int64  `json:"age"` // seconds since the newest snapshot
+}
+
+func (o *statusOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--vmid' requires a VMID")
+		}
+		o.vmid = vmid
+	case "output":
+		if value != "table" && value != "json" {
+			return true, fmt.Errorf("option '--output' must be table or json")
+		}
+		o.output = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Show the protection state of the guests of the node
+func statusCommand(ctx context.Context, e Exec, args []string) error {
+	options := statusOptions{output: "table"}
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	guests, err := guestStatuses(ctx, e, source, env, options)
+	if err != nil {
+		return err
+	}
+	return writeStatus(os.Stdout, guests, options.output)
+}
+
+// Get the protection state of the guests as the next run with the same parameters sees it
+func guestStatuses(ctx context.Context, e Exec, source VMSource, env environment, options statusOptions) ([]guestStatus, error) {
+	vms, err := ListVMs(ctx, source, env.hostname)
+	if err != nil {
+		return nil, err
+	}
+	var guests []guestStatus
+	byVMID := make(map[int]*guestStatus)
+	for _, vm := range vms {
+		if options.vmid == 0 || vm.VMID == options.vmid {
+			guests = append(guests, guestStatus{VMID: vm.VMID, Name: vm.Name, Node: vm.Node, Status: vm.Status, Template: vm.Template == 1})
+		}
+	}
+	sort.Slice(guests, func(i, j int) bool { return guests[i].VMID < guests[j].VMID })
+	for i := range guests {
+		byVMID[guests[i].VMID] = &guests[i]
+	}
+
+	configs, err := readGuestConfigs(env.hostname, vms)
+	if err != nil {
+		return nil, err
+	}
+	// Other formats are parsed, the note would break them
+	if configs == nil && options.output == "table" {
+		logUncheckedConfigs(env.hostname)
+	}
+	planned := newRunGuests(vms, configs)
+	for i := range guests {
+		guests[i].Lock = planned.deferred[guests[i].VMID]
+	}
+
+	pools, err := ZpoolList(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	pools, missing := env.filter.filterPools(pools)
+	if options.output == "table" {
+		logMissingPools(missing)
+	}
+	allVMIDs := GetAllVMIDs(vms)
+	for _, pool := range pools {
+		allZFS, err := ZFSlist(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		// Replicas, templates and deferred guests are shown, but the run does not change their label:running
+		allZFS = markReplicas(filterZfsInVms(env.filter.filterDatasets(allZFS), allVMIDs), configs)
+		ownZFS := filterZfsInVms(filterReplicas(allZFS), planned.all)
+		runningZFS := filterZfsInVms(ownZFS, planned.running)
+		pendingStopZFS := getPendingStopZFS(ownZFS, runningZFS, env.hostname)
+		pendingStartZFS := getPendingStartZFS(ownZFS, runningZFS, env.hostname)
+
+		poolSnapshots, err := ZfsListPoolSnapshots(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		naming := env.namingOf(pool)
+		for _, zfs := range allZFS {
+			guest, ok := byVMID[vmidOf(zfs.name)]
+			if !ok {
+				continue
+			}
+			disk := diskStatus{Disk: zfs.name, Running: zfs.running, NoSnap: zfs.nosnap, Replica: zfs.replica}
+			switch {
+			case containsZFS(pendingStopZFS, zfs):
+				disk.Pending = "stopped snapshot"
+			case containsZFS(pendingStartZFS, zfs):
+				disk.Pending = "set running"
+			}
+			// Templates follow the template policy
+			policies := env.policy
+			if guest.Template {
+				policies = env.templatePolicy
+			}
+			groupedSnapshots := splitSnapshots(poolSnapshots[zfs.name], naming)
+			for _, tier := range tiers {
+				snapshots := groupedSnapshots[tier]
+				if len(snapshots) == 0 && policies[tier].count == 0 {
+					continue
+				}
+				status := tierStatus{Tier: tier, Count: len(snapshots), Policy: policies[tier].count}
+				if len(snapshots) > 0 {
+					newest := snapshots[len(snapshots)-1]
+					_, status.Newest, _ = strings.Cut(newest.name, "@")
+					status.Age = env.time.unix - newest.creation
+				}
+				disk.Tiers = append(disk.Tiers, status)
+			}
+			guest.Disks = append(guest.Disks, disk)
+		}
+	}
+	for i := range guests {
+		guests[i].judge(env.policy, env.templatePolicy)
+	}
+	return guests, nil
+}
+
+// Get the age after which the newest snapshot of a tier is overdue.
+// The run is expected every 15 minutes, an hour covers a few missed runs.
+func staleAfter(p policy) int64 {
+	return max(2*p.interval, 3600)
+}
+
+// Set the health verdict of a guest. Replicas, templates and deferred guests are not snapshotted
+// by design, they get their own verdicts instead of UNPROTECTED or STALE.
+func (g *guestStatus) judge(policies map[string]policy, templatePolicy map[string]policy) {
+	g.Verdict = statusOK
+	g.Reasons = []string{}
+	if g.Template && templatePolicy == nil {
+		g.Verdict = statusTemplate
+		g.Reasons = append(g.Reasons, "templates are snapshotted only with --template-policy")
+		return
+	}
+	if len(g.Disks) == 0 {
+		g.Verdict = statusUnprotected
+		g.Reasons = append(g.Reasons, "no ZFS disks")
+		return
+	}
+	replicas := 0
+	for _, disk := range g.Disks {
+		if disk.Replica != "" {
+			replicas++
+			g.Reasons = append(g.Reasons, fmt.Sprintf("%s is a received replica (%s), the sending side snapshots it", disk.Disk, disk.Replica))
+			continue
+		}
+		if disk.NoSnap {
+			g.Verdict = statusUnprotected
+			g.Reasons = append(g.Reasons, fmt.Sprintf("%s is excluded with nosnap", disk.Disk))
+			continue
+		}
+		var count int
+		for _, tier := range disk.Tiers {
+			count += tier.Count
+		}
+		if count == 0 {
+			g.Verdict = statusUnprotected
+			g.Reasons = append(g.Reasons, fmt.Sprintf("%s has no snapshots", disk.Disk))
+			continue
+		}
+		// Stopped guests and templates are not snapshotted, their disks do not change
+		if g.Status != "running" || g.Template {
+			continue
+		}
+		for _, tier := range disk.Tiers {
+			p, ok := policies[tier.Tier]
+			if !ok || p.count == 0 || p.skipUnchanged {
+				continue
+			}
+			if tier.Count == 0 || tier.Age > staleAfter(p) {
+				if g.Verdict == statusOK {
+					g.Verdict = statusStale
+				}
+				g.Reasons = append(g.Reasons, fmt.Sprintf("%s has no %s snapshot for %s", disk.Disk, tier.Tier, formatAge(staleAfter(p))))
+			}
+		}
+	}
+	if replicas == len(g.Disks) {
+		g.Verdict = statusReplica
+	}
+	if g.Lock != "" && (g.Verdict == statusStale || g.Verdict == statusUnprotected) {
+		g.Verdict = statusDeferred
+		g.Reasons = append(g.Reasons, fmt.Sprintf("locked (%s), the next run defers it", g.Lock))
+	}
+}
+
+func writeStatus(w io.Writer, guests []guestStatus, output string) error {
+	if output == "json" {
+		data, err := json.MarshalIndent(guests, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	for _, guest := range guests {
+		fmt.Fprintf(w, "%d %s (%s on %s", guest.VMID, guest.Name, guest.Status, guest.Node)
+		if guest.Lock != "" {
+			fmt.Fprintf(w, ", locked: %s", guest.Lock)
+		}
+		fmt.Fprintf(w, "): %s\n", guest.Verdict)
+		for _, reason := range guest.Reasons {
+			fmt.Fprintf(w, "  ! %s\n", reason)
+		}
+		for _, disk := range guest.Disks {
+			fmt.Fprintf(w, "  %s label:running=%s", disk.Disk, disk.Running)
+			if disk.NoSnap {
+				fmt.Fprint(w, " nosnap")
+			}
+			if disk.Replica != "" {
+				fmt.Fprintf(w, " replica (%s)", disk.Replica)
+			}
+			if disk.Pending != "" {
+				fmt.Fprintf(w, " next run: %s", disk.Pending)
+			}
+			fmt.Fprintln(w)
+			for _, tier := range disk.Tiers {
+				fmt.Fprintf(w, "    %-10s %d/%d", tier.Tier, tier.Count, tier.Policy)
+				if tier.Newest != "" {
+					fmt.Fprintf(w, " newest %s (%s ago)", tier.Newest, formatAge(tier.Age))
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+	return nil
+}
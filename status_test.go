@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGuestStatuses(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	env := runTestEnv(t, "h2", "d7")
+	guests, err := guestStatuses(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, statusOptions{})
+	if err != nil {
+		t.Fatalf("guestStatuses returned error: %v", err)
+	}
+	expected := []guestStatus{
+		{
+			VMID: 100, Name: "web", Node: "HOST-1", Status: "running",
+			Disks: []diskStatus{{
+				Disk: "rpool/data/vm-100-disk-0", Running: "HOST-1",
+				Tiers: []tierStatus{
+					{Tier: daily, Policy: 7},
+					{Tier: hourly, Count: 2, Policy: 2, Newest: "autosnap_2023-01-24_07:00:02_hourly", Age: 3600},
+				},
+			}},
+			Verdict: statusStale,
+			Reasons: []string{"rpool/data/vm-100-disk-0 has no daily snapshot for 2d0h"},
+		},
+		{
+			VMID: 101, Name: "db", Node: "HOST-1", Status: "stopped",
+			Disks: []diskStatus{{
+				Disk: "rpool/data/subvol-101-disk-0", Running: "HOST-1", Pending: "stopped snapshot",
+				Tiers: []tierStatus{{Tier: daily, Policy: 7}, {Tier: hourly, Policy: 2}},
+			}},
+			Verdict: statusUnprotected,
+			Reasons: []string{"rpool/data/subvol-101-disk-0 has no snapshots"},
+		},
+	}
+	if !reflect.DeepEqual(guests, expected) {
+		t.Errorf("guestStatuses() = %+v, want %+v", guests, expected)
+	}
+}
+
+func TestGuestStatusesFilter(t *testing.T) {
+	// The guests have copies on the backup pool, the filters of a run leave them out
+	mockExec := newRunTestExec("rpool", "backup")
+	env := runTestEnv(t, "h2", "--exclude-pool=backup", "--exclude-dataset=rpool/data/subvol-101-disk-0")
+	guests, err := guestStatuses(context.Background(), mockExec, PveshSource{Exec: mockExec}, env, statusOptions{output: "json"})
+	if err != nil {
+		t.Fatalf("guestStatuses returned error: %v", err)
+	}
+	var disks []string
+	for _, guest := range guests {
+		for _, disk := range guest.Disks {
+			disks = append(disks, disk.Disk)
+		}
+	}
+	if expected := []string{"rpool/data/vm-100-disk-0"}; !reflect.DeepEqual(disks, expected) {
+		t.Errorf("disks = %v, want %v", disks, expected)
+	}
+}
+
+func TestGuestStatusesReplica(t *testing.T) {
+	newReplicaTestDir(t, map[string]string{"qemu-server/100.conf": "scsi0: local-zfs:vm-100-disk-0,size=32G\n"})
+	mockExec := newRunTestExec("rpool")
+	guests, err := guestStatuses(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t, "h2"), statusOptions{vmid: 101})
+	if err != nil {
+		t.Fatalf("guestStatuses returned error: %v", err)
+	}
+	// The replica is shown, but the next run leaves it alone
+	expected := []diskStatus{{
+		Disk: "rpool/data/subvol-101-disk-0", Running: "HOST-1", Replica: "no guest config",
+		Tiers: []tierStatus{{Tier: hourly, Policy: 2}},
+	}}
+	if len(guests) != 1 || !reflect.DeepEqual(guests[0].Disks, expected) {
+		t.Fatalf("guestStatuses() = %+v, want disks %+v", guests, expected)
+	}
+	if guests[0].Verdict != statusReplica {
+		t.Errorf("verdict %s, want %s (%v)", guests[0].Verdict, statusReplica, guests[0].Reasons)
+	}
+}
+
+func TestGuestStatusJudge(t *testing.T) {
+	policies := map[string]policy{hourly: {count: 24, interval: 3600}}
+	tests := []struct {
+		name    string
+		guest   guestStatus
+		verdict string
+	}{
+		{"fresh", guestStatus{Status: "running", Disks: []diskStatus{{Tiers: []tierStatus{{Tier: hourly, Count: 3, Age: 1800}}}}}, statusOK},
+		{"overdue", guestStatus{Status: "running", Disks: []diskStatus{{Tiers: []tierStatus{{Tier: hourly, Count: 3, Age: 7300}}}}}, statusStale},
+		{"stopped", guestStatus{Status: "stopped", Disks: []diskStatus{{Tiers: []tierStatus{{Tier: hourly, Count: 3, Age: 86400}}}}}, statusOK},
+		{"nosnap", guestStatus{Status: "running", Disks: []diskStatus{{NoSnap: true}}}, statusUnprotected},
+		{"no disks", guestStatus{Status: "running"}, statusUnprotected},
+		{"replica", guestStatus{Status: "running", Disks: []diskStatus{{Replica: "readonly (received)"}}}, statusReplica},
+		{"replica and own disk", guestStatus{Status: "running", Disks: []diskStatus{{Replica: "not in guest config"}, {NoSnap: true}}}, statusUnprotected},
+		{"deferred", guestStatus{Status: "running", Lock: "backup", Disks: []diskStatus{{Tiers: []tierStatus{{Tier: hourly, Count: 3, Age: 7300}}}}}, statusDeferred},
+		{"deferred fresh", guestStatus{Status: "running", Lock: "backup", Disks: []diskStatus{{Tiers: []tierStatus{{Tier: hourly, Count: 3, Age: 1800}}}}}, statusOK},
+		{"template", guestStatus{Status: "stopped", Template: true, Disks: []diskStatus{{}}}, statusTemplate},
+	}
+	for _, test := range tests {
+		test.guest.judge(policies, nil)
+		if test.guest.Verdict != test.verdict {
+			t.Errorf("%s: verdict %s, want %s (%v)", test.name, test.guest.Verdict, test.verdict, test.guest.Reasons)
+		}
+	}
+}
+
+func TestGuestStatusJudgeTemplatePolicy(t *testing.T) {
+	templatePolicy := map[string]policy{monthly: {count: 1, interval: tierIntervals[monthly]}}
+	guest := guestStatus{Status: "stopped", Template: true, Disks: []diskStatus{{Tiers: []tierStatus{{Tier: monthly, Count: 1, Age: 90 * 86400}}}}}
+	guest.judge(nil, templatePolicy)
+	if guest.Verdict != statusOK {
+		t.Errorf("verdict %s, want %s (%v)", guest.Verdict, statusOK, guest.Reasons)
+	}
+	guest = guestStatus{Status: "stopped", Template: true, Disks: []diskStatus{{Tiers: []tierStatus{{Tier: monthly}}}}}
+	guest.judge(nil, templatePolicy)
+	if guest.Verdict != statusUnprotected {
+		t.Errorf("verdict %s, want %s (%v)", guest.Verdict, statusUnprotected, guest.Reasons)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	guests := []guestStatus{{
+		VMID: 100, Name: "web", Node: "HOST-1", Status: "running", Verdict: statusOK, Reasons: []string{},
+		Disks: []diskStatus{{
+			Disk: "rpool/data/vm-100-disk-0", Running: "HOST-1",
+			Tiers: []tierStatus{{Tier: hourly, Count: 2, Policy: 2, Newest: "autosnap_2023-01-24_07:00:02_hourly", Age: 3600}},
+		}},
+	}}
+	var output bytes.Buffer
+	if err := writeStatus(&output, guests, "table"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "100 web (running on HOST-1): OK\n" +
+		"  rpool/data/vm-100-disk-0 label:running=HOST-1\n" +
+		"    hourly     2/2 newest autosnap_2023-01-24_07:00:02_hourly (1h0m ago)\n"
+	if output.String() != expected {
+		t.Errorf("unexpected status:\n%s\nwant:\n%s", output.String(), expected)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+type usageOptions struct {
+	vmid   int // 0 - all guests
+	output string
+}
+
+// Change rate of a guest over the time span of a tier
+type usageRow struct {
+	VMID      int    `json:"vmid"`
+	Guest     string `json:"guest"`
+	Tier      string `json:"tier"`
+	Snapshots int    `json:"snapshots"`
+	Used      int64  `json:"used"`    // space held only by the snapshots of the tier
+	Span      int64  `json:"span"`    // seconds between the oldest and the newest snapshot of the tier
+	Written   int64  `json:"written"` // bytes written during the span
+	// Bytes written per hour during the span
+	Rate int64 `json:"rate"`
+	// Average size of an incremental send between two snapshots of the tier
+	PerInterval int64 `json:"per_interval"`
+	// Predicted replication volume per day
+	PerDay int64 `json:"per_day"`
+}
+
+func (o *usageOptions) setOption(name string, value string) (bool, error) {
+	switch name {
+	case "vmid":
+		vmid, err := strconv.Atoi(value)
+		if err != nil || vmid <= 0 {
+			return true, fmt.Errorf("option '--vmid' requires a VMID")
+		}
+		o.vmid = vmid
+	case "output":
+		if value != "table" && value != "json" && value != "csv" {
+			return true, fmt.Errorf("option '--output' must be table, json or csv")
+		}
+		o.output = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Show change rates of the guests of the node
+func usageCommand(ctx context.Context, e Exec, args []string) error {
+	options := usageOptions{output: "table"}
+	env, err := subcommandEnvironment(args, options.setOption)
+	if err != nil {
+		return err
+	}
+	source, err := getVMSource(e, env.api)
+	if err != nil {
+		return err
+	}
+	rows, err := guestUsage(ctx, e, source, env, options)
+	if err != nil {
+		return err
+	}
+	return writeUsage(os.Stdout, rows, options.output)
+}
+
+// Aggregate written and used of the snapshots per guest and tier
+func guestUsage(ctx context.Context, e Exec, source VMSource, env environment, options usageOptions) ([]usageRow, error) {
+	vms, err := ListVMs(ctx, source, env.hostname)
+	if err != nil {
+		return nil, err
+	}
+	guests := make(map[int]string)
+	var vmIDs []int
+	for _, vm := range vms {
+		if options.vmid == 0 || vm.VMID == options.vmid {
+			guests[vm.VMID] = vm.Name
+			vmIDs = append(vmIDs, vm.VMID)
+		}
+	}
+	if len(vmIDs) == 0 {
+		return []usageRow{}, nil
+	}
+	pools, err := ZpoolList(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	pools, missing := env.filter.filterPools(pools)
+	if options.output == "table" {
+		logMissingPools(missing)
+	}
+
+	type key struct {
+		vmid int
+		tier string
+	}
+	usage := make(map[key]*usageRow)
+	for _, pool := range pools {
+		allZFS, err := ZFSlist(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		poolSnapshots, err := ZfsListPoolSnapshots(ctx, e, pool)
+		if err != nil {
+			return nil, err
+		}
+		naming := env.namingOf(pool)
+		for _, zfs := range filterZfsInVms(env.filter.filterDatasets(allZFS), vmIDs) {
+			vmid := vmidOf(zfs.name)
+			// written of a snapshot is the data written since the previous snapshot of the dataset,
+			// manual and foreign snapshots included, only the totals are attributed to the tiers
+			all := slices.Clone(poolSnapshots[zfs.name])
+			sortSnapshots(all)
+			for tier, snapshots := range splitSnapshots(all, naming) {
+				row, ok := usage[key{vmid, tier}]
+				if !ok {
+					row = &usageRow{VMID: vmid, Guest: guests[vmid], Tier: tier}
+					usage[key{vmid, tier}] = row
+				}
+				row.Snapshots = max(row.Snapshots, len(snapshots))
+				for _, snapshot := range snapshots {
+					row.Used += snapshot.used
+				}
+				oldest, newest := snapshots[0], snapshots[len(snapshots)-1]
+				row.Span = max(row.Span, newest.creation-oldest.creation)
+				row.Written += writtenBetween(all, oldest, newest)
+			}
+		}
+	}
+
+	rows := []usageRow{}
+	for _, row := range usage {
+		if row.Span > 0 {
+			row.Rate = row.Written * 3600 / row.Span
+			row.PerDay = row.Written * 86400 / row.Span
+		}
+		if row.Snapshots > 1 {
+			row.PerInterval = row.Written / int64(row.Snapshots-1)
+		}
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].VMID != rows[j].VMID {
+			return rows[i].VMID < rows[j].VMID
+		}
+		return slices.Index(tiers, rows[i].Tier) < slices.Index(tiers, rows[j].Tier)
+	})
+	return rows, nil
+}
+
+// Sum written of the snapshots after oldest up to newest. Blocks rewritten between
+// snapshots are counted more than once, so the sum is an upper bound of an incremental send.
+func writtenBetween(all []snapshot, oldest snapshot, newest snapshot) int64 {
+	var written int64
+	inside := false
+	for _, snapshot := range all {
+		if inside {
+			written += snapshot.written
+		}
+		if snapshot.name == oldest.name {
+			inside = true
+		}
+		if snapshot.name == newest.name {
+			break
+		}
+	}
+	return written
+}
+
+func writeUsage(w io.Writer, rows []usageRow, output string) error {
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"vmid", "guest", "tier", "snapshots", "used", "span", "written", "rate", "per_interval", "per_day"})
+		for _, row := range rows {
+			writer.Write([]string{
+				strconv.Itoa(row.VMID), row.Guest, row.Tier, strconv.Itoa(row.Snapshots),
+				strconv.FormatInt(row.Used, 10), strconv.FormatInt(row.Span, 10), strconv.FormatInt(row.Written, 10),
+				strconv.FormatInt(row.Rate, 10), strconv.FormatInt(row.PerInterval, 10), strconv.FormatInt(row.PerDay, 10),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "VMID\tGUEST\tTIER\tSNAPSHOTS\tUSED\tSPAN\tWRITTEN\tRATE/H\tPER INTERVAL\tPER DAY")
+	for _, row := range rows {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.VMID, row.Guest, row.Tier, row.Snapshots, formatBytes(row.Used), formatAge(row.Span),
+			formatBytes(row.Written), formatBytes(row.Rate), formatBytes(row.PerInterval), formatBytes(row.PerDay))
+	}
+	return writer.Flush()
+}
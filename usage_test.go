@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGuestUsage(t *testing.T) {
+	mockExec := newRunTestExec("rpool")
+	// Frequently and manual snapshots between the hourly ones, written is counted since the previous snapshot of any kind
+	mockExec.Outputs[runTestSnapshotsKey+"rpool"] = []byte(
+		"rpool/data/vm-100-disk-0@autosnap_2023-01-24_06:00:02_hourly\t1674540002\t0\t100\t1000\t100\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-24_06:30:02_frequently\t1674541802\t0\t200\t2000\t150\t0\n" +
+			"rpool/data/vm-100-disk-0@before-upgrade\t1674542000\t0\t0\t500\t175\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-24_07:00:02_hourly\t1674543602\t0\t300\t3000\t200\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-24_07:30:02_frequently\t1674545402\t0\t400\t4000\t250\t0\n" +
+			"rpool/data/vm-100-disk-0@autosnap_2023-01-24_08:00:02_hourly\t1674547202\t0\t500\t5000\t300\t0\n" +
+			"rpool/data/vm-100-disk-0@manual\t1674547300\t0\t0\t9999\t301\t0\n")
+	rows, err := guestUsage(context.Background(), mockExec, PveshSource{Exec: mockExec}, runTestEnv(t), usageOptions{vmid: 100})
+	if err != nil {
+		t.Fatalf("guestUsage returned error: %v", err)
+	}
+	expected := []usageRow{
+		{VMID: 100, Guest: "web", Tier: hourly, Snapshots: 3, Used: 900, Span: 7200, Written: 14500, Rate: 7250, PerInterval: 7250, PerDay: 174000},
+		{VMID: 100, Guest: "web", Tier: frequently, Snapshots: 2, Used: 600, Span: 3600, Written: 7500, Rate: 7500, PerInterval: 7500, PerDay: 180000},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("guestUsage() = %+v, want %+v", rows, expected)
+	}
+}
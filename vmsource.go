@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VMSource lists the guests of the cluster
+type VMSource interface {
+	ClusterResources(ctx context.Context) ([]VM, error)
+}
+
+// PveshSource lists guests with pvesh, it works only on a PVE node
+type PveshSource struct {
+	Exec Exec
+}
+
+func (s PveshSource) ClusterResources(ctx context.Context) ([]VM, error) {
+	output, err := command(ctx, s.Exec, "pvesh", "get", "/cluster/resources", "--type", "vm", "--output-format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var vms []VM
+	if err := json.Unmarshal(output, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// APISource lists guests with the Proxmox REST API, so it works from any host
+type APISource struct {
+	URL    string // e.g. https://pve1:8006
+	Token  string // USER@REALM!TOKENID=SECRET
+	Client *http.Client
+}
+
+// Settings of the REST API client
+type apiConfig struct {
+	url         string
+	tokenFile   string
+	caFile      string // trust only this CA
+	fingerprint string // SHA-256 fingerprint of the server certificate
+}
+
+// Create the API source, the server certificate is checked against the pinned CA or fingerprint
+func NewAPISource(config apiConfig) (*APISource, error) {
+	token, err := os.ReadFile(config.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API token: %v", err)
+	}
+	tlsConfig := &tls.Config{}
+	if config.caFile != "" {
+		pem, err := os.ReadFile(config.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.caFile)
+		}
+	}
+	if config.fingerprint != "" {
+		pinned := normalizeFingerprint(config.fingerprint)
+		// Proxmox uses self-signed certificates, the pinned fingerprint replaces the chain check
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server has no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != pinned {
+				return fmt.Errorf("server certificate fingerprint does not match the pinned one")
+			}
+			return nil
+		}
+	}
+	return &APISource{
+		URL:   strings.TrimRight(config.url, "/"),
+		Token: string(bytes.TrimSpace(token)),
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// Convert 'AB:CD:...' to 'abcd...'
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+func (s *APISource) ClusterResources(ctx context.Context) ([]VM, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL+"/api2/json/cluster/resources?type=vm", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+s.Token)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /cluster/resources: %s", resp.Status)
+	}
+	var body struct {
+		Data []VM `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Data, nil
+}
+
+// Get the VM source configured by the options, guests can not be listed if the API source fails
+func getVMSource(e Exec, config apiConfig) (VMSource, error) {
+	if config.url == "" {
+		return PveshSource{Exec: e}, nil
+	}
+	source, err := NewAPISource(config)
+	if err != nil {
+		return nil, &DiscoveryError{err}
+	}
+	return source, nil
+}
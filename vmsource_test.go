@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fake Proxmox API replaying the recorded /cluster/resources response
+func newFakeAPI(t *testing.T) *httptest.Server {
+	recorded, err := os.ReadFile("testdata/cluster_resources.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "PVEAPIToken=root@pam!snap=secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api2/json/cluster/resources" || r.URL.Query().Get("type") != "vm" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(recorded)
+	}))
+}
+
+func writeTokenFile(t *testing.T, token string) string {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAPISourceFingerprint(t *testing.T) {
+	server := newFakeAPI(t)
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().Raw)
+
+	source, err := NewAPISource(apiConfig{
+		url:         server.URL,
+		tokenFile:   writeTokenFile(t, "root@pam!snap=secret"),
+		fingerprint: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatalf("NewAPISource returned error: %v", err)
+	}
+	vms, err := ListVMs(context.Background(), source, "AX101-Falk-01")
+	if err != nil {
+		t.Fatalf("ListVMs returned error: %v", err)
+	}
+	if len(vms) != 1 || vms[0].VMID != 952 || vms[0].Tags != "db;snap-freeze" {
+		t.Errorf("unexpected VMs: %+v", vms)
+	}
+}
+
+func TestAPISourceWrongFingerprint(t *testing.T) {
+	server := newFakeAPI(t)
+	defer server.Close()
+
+	source, err := NewAPISource(apiConfig{
+		url:         server.URL,
+		tokenFile:   writeTokenFile(t, "root@pam!snap=secret"),
+		fingerprint: "00:11:22",
+	})
+	if err != nil {
+		t.Fatalf("NewAPISource returned error: %v", err)
+	}
+	if _, err := source.ClusterResources(context.Background()); err == nil {
+		t.Errorf("expected error for a wrong fingerprint")
+	}
+}
+
+func TestAPISourceUnauthorized(t *testing.T) {
+	server := newFakeAPI(t)
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().Raw)
+
+	source, err := NewAPISource(apiConfig{
+		url:         server.URL,
+		tokenFile:   writeTokenFile(t, "root@pam!snap=wrong"),
+		fingerprint: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatalf("NewAPISource returned error: %v", err)
+	}
+	if _, err := source.ClusterResources(context.Background()); err == nil {
+		t.Errorf("expected error for a wrong token")
+	}
+}
+
+func TestAPISourceCanceled(t *testing.T) {
+	server := newFakeAPI(t)
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().Raw)
+
+	source, err := NewAPISource(apiConfig{
+		url:         server.URL,
+		tokenFile:   writeTokenFile(t, "root@pam!snap=secret"),
+		fingerprint: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatalf("NewAPISource returned error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := source.ClusterResources(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled request, got %v", err)
+	}
+}
+
+func TestGetVMSourceUnreadableToken(t *testing.T) {
+	source, err := getVMSource(&MockExec{}, apiConfig{url: "https://pve1:8006", tokenFile: filepath.Join(t.TempDir(), "missing")})
+	if source != nil || exitCode(err) != exitDiscovery {
+		t.Errorf("getVMSource() = %v, %v, want a discovery error", source, err)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
-	"strings"
+	"slices"
+	"sort"
+	"syscall"
 )
 
 type Pending struct {
@@ -14,40 +16,181 @@ type Pending struct {
 	Destroys   []string
 	SetRunning []string
 	SetStopped []string
+	Holds      []string // snapshots to hold with keepTag
+	Releases   []string // snapshots to release from keepTag
+	Held       []string // snapshots which were not destroyed because of holds
+	Guard      destroyGuard
+	Existing   map[string]int // number of existing snapshots per dataset
+	Rotated    map[string]int // number of tiers of a dataset whose policy destroys snapshots
+	DryRun     bool           // print the plan instead of running it
+
+	SpacePrunes     []string // snapshots destroyed to free space
+	spaceCandidates []spaceCandidate
+
+	snapshotsCreated bool
+	freezeLabeled    []int                    // VMIDs with label:snap-freeze=on on a disk
+	results          map[string]programResult // results of channel programs by action, for the report
+}
+
+// Result of a channel program
+type programResult struct {
+	Succeeded map[string]int64 `json:"succeeded"`
+	Failed    map[string]int64 `json:"failed"`
+	Held      map[string]int64 `json:"held"`
 }
 
-func (p *Pending) Run() error {
+func (p *Pending) Run(ctx context.Context, e Exec) error {
 	if p.Pool == "" {
 		return fmt.Errorf("pool is empty")
 	}
-	if len(p.Snapshots) > 0 {
-		_, _ = program(p.Pool, "lua_snapshot", p.Snapshots)
-		// fmt.Println("snapshots", p.Snapshots)
+	guardErr := p.checkDestroys()
+	// The refusal itself is printed once by the caller with the other errors of the run
+	if guardErr != nil {
+		for _, name := range p.Destroys {
+			if !slices.Contains(p.SpacePrunes, name) {
+				fmt.Printf("would destroy %s\n", name)
+			}
+		}
+		// Space prunes are exempt from the guard
+		p.Destroys = slices.Clone(p.SpacePrunes)
+		p.Releases = nil
+	}
+	if p.DryRun {
+		p.printPlan()
+		return guardErr
+	}
+	if err := p.CreateSnapshots(ctx, e); err != nil {
+		return err
+	}
+	// There is no hold/release in channel programs, so holds are placed with the zfs command
+	if len(p.Holds) > 0 {
+		if _, err := command(ctx, e, "zfs", append([]string{"hold", keepTag}, p.Holds...)...); err != nil {
+			return err
+		}
+	}
+	if len(p.Releases) > 0 {
+		if _, err := command(ctx, e, "zfs", append([]string{"release", keepTag}, p.Releases...)...); err != nil {
+			return err
+		}
 	}
 	if len(p.Destroys) > 0 {
-		_, _ = program(p.Pool, "lua_destroy", p.Destroys)
-		// fmt.Println("destroys", p.Destroys)
+		result, err := program(ctx, e, p.Pool, "lua_destroy", p.Destroys)
+		if err != nil {
+			return err
+		}
+		p.record("destroy", result)
+		p.Held = sortedKeys(result.Held)
+		for _, name := range p.Held {
+			fmt.Printf("snapshot %s is held, skipping destroy\n", name)
+		}
 	}
 	if len(p.SetRunning) > 0 {
 		args := append([]string{p.Hosname}, p.SetRunning...)
-		_, _ = program(p.Pool, "lua_set_running", args)
-		// fmt.Println("set_running", p.SetRunning)
+		result, err := program(ctx, e, p.Pool, "lua_set_running", args)
+		if err != nil {
+			return err
+		}
+		p.record("set running", result)
 	}
 	if len(p.SetStopped) > 0 {
 		args := append([]string{"stopped"}, p.SetStopped...)
-		_, _ = program(p.Pool, "lua_set_running", args)
-		// fmt.Println("unset_running", p.UnsetRunning)
+		result, err := program(ctx, e, p.Pool, "lua_set_running", args)
+		if err != nil {
+			return err
+		}
+		p.record("set stopped", result)
 	}
+	return guardErr
+}
+
+// Create pending snapshots in one channel program.
+// It may be called before Run to create snapshots while guests are frozen.
+func (p *Pending) CreateSnapshots(ctx context.Context, e Exec) error {
+	if p.snapshotsCreated || p.DryRun || len(p.Snapshots) == 0 {
+		return nil
+	}
+	p.snapshotsCreated = true
+	result, err := program(ctx, e, p.Pool, "lua_snapshot", p.Snapshots)
+	if err != nil {
+		return err
+	}
+	p.record("snapshot", result)
+	// Do not hold snapshots which were not created
+	var holds []string
+	for _, name := range p.Holds {
+		if _, ok := result.Failed[name]; !ok {
+			holds = append(holds, name)
+		}
+	}
+	p.Holds = holds
 	return nil
 }
 
-func program(pool string, program string, args []string) (string, error) {
-	output, err := exec.Command("bash", "-c",
-		fmt.Sprintf("zfs program %s <(%s %s) %s",
-			pool, os.Args[0], program, strings.Join(args, " ")),
-	).Output()
+// Print what Run would do
+func (p *Pending) printPlan() {
+	fmt.Printf("plan for pool %s:\n", p.Pool)
+	steps := []struct {
+		action string
+		names  []string
+	}{
+		{"snapshot", p.Snapshots},
+		{"hold", p.Holds},
+		{"release", p.Releases},
+		{"destroy", p.Destroys},
+		{"set running", p.SetRunning},
+		{"set stopped", p.SetStopped},
+	}
+	for _, step := range steps {
+		for _, name := range step.names {
+			fmt.Printf("  %s %s\n", step.action, name)
+		}
+	}
+}
+
+// Remember the result of a channel program and print its failures
+func (p *Pending) record(action string, result programResult) {
+	if p.results == nil {
+		p.results = make(map[string]programResult)
+	}
+	p.results[action] = result
+	reportFailed(action, result)
+}
+
+// Print names which a channel program failed to process
+func reportFailed(action string, result programResult) {
+	for _, name := range sortedKeys(result.Failed) {
+		fmt.Printf("failed to %s %s: %s\n", action, name, syscall.Errno(result.Failed[name]))
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Run a channel program, the lua code is passed through stdin
+func program(ctx context.Context, e Exec, pool string, program string, args []string) (programResult, error) {
+	code, ok := luaPrograms[program]
+	if !ok {
+		return programResult{}, fmt.Errorf("unknown program %s", program)
+	}
+	output, err := e.Run(ctx, Cmd{
+		Name:  "zfs",
+		Args:  append([]string{"program", "-j", pool, "/dev/stdin"}, args...),
+		Stdin: []byte(code()),
+	})
 	if err != nil {
-		return "", err
+		return programResult{}, err
+	}
+	var result struct {
+		Return programResult `json:"return"`
+	}
+	if err := json.Unmarshal(output.Stdout, &result); err != nil {
+		return programResult{}, fmt.Errorf("unexpected output of %s: %v", program, err)
 	}
-	return string(output), nil
+	return result.Return, nil
 }
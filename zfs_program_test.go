@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func programKey(pool string, args string) string {
+	return "zfs program -j " + pool + " /dev/stdin " + args
+}
+
+func TestPendingRunHeld(t *testing.T) {
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			programKey("rpool", "rpool/a@s1 rpool/a@s2"): []byte(
+				`{"return": {"succeeded": {"rpool/a@s1": 0}, "failed": {}, "held": {"rpool/a@s2": 1}}}`),
+			"zfs release pve-zfs-snap-keep rpool/a@s1": nil,
+		},
+		Stdin: map[string][]byte{},
+	}
+	pending := Pending{
+		Pool:     "rpool",
+		Destroys: []string{"rpool/a@s1", "rpool/a@s2"},
+		Releases: []string{"rpool/a@s1"},
+	}
+	if err := pending.Run(context.Background(), mockExec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(pending.Held, []string{"rpool/a@s2"}) {
+		t.Errorf("unexpected held: %v", pending.Held)
+	}
+	if string(mockExec.Stdin[programKey("rpool", "rpool/a@s1 rpool/a@s2")]) != lua_destroy() {
+		t.Errorf("destroy program was not passed through stdin")
+	}
+}
+
+func TestPendingRunSkipsHoldOfFailedSnapshot(t *testing.T) {
+	mockExec := &MockExec{
+		Outputs: map[string][]byte{
+			programKey("rpool", "rpool/a@s1 rpool/b@s1"): []byte(
+				`{"return": {"succeeded": {"rpool/a@s1": 0}, "failed": {"rpool/b@s1": 28}}}`),
+			"zfs hold pve-zfs-snap-keep rpool/a@s1": nil,
+		},
+	}
+	pending := Pending{
+		Pool:      "rpool",
+		Snapshots: []string{"rpool/a@s1", "rpool/b@s1"},
+		Holds:     []string{"rpool/a@s1", "rpool/b@s1"},
+	}
+	if err := pending.Run(context.Background(), mockExec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(pending.Holds, []string{"rpool/a@s1"}) {
+		t.Errorf("unexpected holds: %v", pending.Holds)
+	}
+}